@@ -1,14 +1,12 @@
 package walmap
 
 import (
-	"bytes"
-	"encoding/gob"
-	"fmt"
 	"io"
-	"os"
 	"sync"
+	"time"
 
 	"github.com/octu0/cmap"
+	"github.com/octu0/walmap/codec"
 	"github.com/pkg/errors"
 )
 
@@ -16,64 +14,109 @@ var (
 	_ cmap.Cache = (*walCache)(nil)
 )
 
-type item struct {
-	Value interface{}
-}
-
 type walCache struct {
 	sync.RWMutex
 
 	log     *Log
 	bufPool BufferPool
+	retired bool // replaced by WALMap.Reshard, callers must look up the shard again
 }
 
 func (w *walCache) Set(key string, value any) {
+	if err := setValueE[any](w, itemCodec{}, key, value); err != nil {
+		defaultErrorHandler("Set", key, err)
+	}
+}
+
+func (w *walCache) Get(key string) (any, bool) {
+	value, ok, err := getValueE[any](w, itemCodec{}, key)
+	if err != nil {
+		defaultErrorHandler("Get", key, err)
+		return nil, false
+	}
+	return value, ok
+}
+
+func (w *walCache) Remove(key string) (interface{}, bool) {
+	value, ok, err := removeValueE[any](w, itemCodec{}, key)
+	if err != nil {
+		defaultErrorHandler("Remove", key, err)
+		return nil, false
+	}
+	return value, ok
+}
+
+func setValueE[V any](w *walCache, valueCodec ValueCodec[V], key string, value V) error {
+	return writeValue(w, valueCodec, key, value, codec.Header{})
+}
+
+func setValueWithExpireE[V any](w *walCache, valueCodec ValueCodec[V], key string, value V, expireAt time.Time) error {
+	return writeValue(w, valueCodec, key, value, codec.Header{ExpireAt: expireAt.UnixNano()})
+}
+
+func writeValue[V any](w *walCache, valueCodec ValueCodec[V], key string, value V, header codec.Header) error {
 	out := w.bufPool.Get()
 	defer w.bufPool.Put(out)
 	out.Reset()
 
-	if err := gob.NewEncoder(out).Encode(item{value}); err != nil {
-		fmt.Fprintf(os.Stderr, "Set(%s): %+v", key, errors.WithStack(err))
-		return
+	if err := valueCodec.Encode(out, value); err != nil {
+		return errors.WithStack(err)
 	}
 
-	if err := w.log.Write(key, out.Bytes()); err != nil {
-		fmt.Fprintf(os.Stderr, "Set(Log(%s)): %+v", key, errors.WithStack(err))
-		return
+	if err := w.log.writeRecord(key, header, out.Bytes()); err != nil {
+		return errors.Wrapf(err, "Log(%s)", key)
 	}
+	return nil
 }
 
-func (w *walCache) Get(key string) (any, bool) {
-	data, ok, err := w.log.Read(key)
+func getValueE[V any](w *walCache, valueCodec ValueCodec[V], key string) (V, bool, error) {
+	var empty V
+	header, data, ok, err := w.log.readRecord(key)
 	if err != nil {
-		return nil, false
+		return empty, false, errors.Wrapf(err, "Log(%s)", key)
 	}
 	if ok != true {
-		return nil, false
+		return empty, false, nil
 	}
 
-	i := item{}
-	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&i); err != nil {
-		fmt.Fprintf(os.Stderr, "Get(%s): %+v", key, errors.WithStack(err))
-		return nil, false
+	value, err := decodeValue(valueCodec, header, data)
+	if err != nil {
+		return empty, false, errors.WithStack(err)
 	}
-	return i.Value, true
+	return value, true, nil
 }
 
-func (w *walCache) Remove(key string) (interface{}, bool) {
-	data, ok, err := w.log.Delete(key)
+func removeValueE[V any](w *walCache, valueCodec ValueCodec[V], key string) (V, bool, error) {
+	var empty V
+	header, data, ok, err := w.log.deleteRecord(key)
 	if err != nil {
-		return nil, false
+		return empty, false, errors.Wrapf(err, "Log(%s)", key)
 	}
 	if ok != true {
-		return nil, false
+		return empty, false, nil
 	}
-	i := item{}
-	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&i); err != nil {
-		fmt.Fprintf(os.Stderr, "Remove(%s): %+v", key, errors.WithStack(err))
-		return nil, false
+	value, err := decodeValue(valueCodec, header, data)
+	if err != nil {
+		return empty, false, errors.WithStack(err)
+	}
+	return value, true, nil
+}
+
+// decodeValue decodes data with valueCodec, unless it was stored by SetBytes and V can hold the []byte as is.
+func decodeValue[V any](valueCodec ValueCodec[V], header codec.Header, data []byte) (V, error) {
+	if header.IsRaw() {
+		if value, ok := any(data).(V); ok {
+			return value, nil
+		}
 	}
-	return i.Value, true
+	return valueCodec.Decode(data)
+}
+
+func setBytes(w *walCache, key string, data []byte) error {
+	if err := w.log.WriteWithFlag(key, codec.FlagRaw, data); err != nil {
+		return errors.Wrapf(err, "Log(%s)", key)
+	}
+	return nil
 }
 
 func (w *walCache) Len() int {
@@ -99,21 +142,76 @@ func (w *walCache) ReclaimableSpace() uint64 {
 	return w.log.ReclaimableSpace()
 }
 
+func (w *walCache) ReapExpired(now time.Time) (int, error) {
+	return w.log.ReapExpired(now)
+}
+
 func (w *walCache) Compact() error {
 	return w.log.Compact()
 }
 
+func (w *walCache) Sync() error {
+	return w.log.Sync()
+}
+
+func (w *walCache) Close() error {
+	return w.log.Close()
+}
+
 func restoreWalCache(r io.Reader, opt *walmapOpt) (*walCache, error) {
 	log, err := RestoreLog(r, opt.initialLogSize, opt.initialIndexSize)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	return &walCache{log: log}, nil
+	return newWalCacheWithLog(log, opt), nil
+}
+
+// restoreLegacyWalCache migrates a shard log written by v1.1.1 (records without flag and checksum).
+func restoreLegacyWalCache(r io.Reader, opt *walmapOpt) (*walCache, error) {
+	log := NewLog(opt.initialLogSize, opt.initialIndexSize)
+	for {
+		key, data, err := codec.DecodeLegacy(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, errors.WithStack(err)
+		}
+		if err := log.Write(key, data); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return newWalCacheWithLog(log, opt), nil
+}
+
+func recoverWalCache(r io.Reader, opt *walmapOpt) (*walCache, Recovery, error) {
+	log, recovery, err := RecoverLog(r, opt.initialLogSize, opt.initialIndexSize)
+	if err != nil {
+		return nil, Recovery{}, errors.WithStack(err)
+	}
+	return newWalCacheWithLog(log, opt), recovery, nil
+}
+
+func openWalCache(path string, opt *walmapOpt) (*walCache, Recovery, error) {
+	log, recovery, err := openLog(path, opt.initialLogSize, opt.initialIndexSize, opt.recoveryFunc != nil)
+	if err != nil {
+		return nil, Recovery{}, errors.WithStack(err)
+	}
+	log.syncOnWrite = opt.syncPolicy.mode == syncModeAlways
+	return newWalCacheWithLog(log, opt), recovery, nil
 }
 
 func newWalCache(opt *walmapOpt) *walCache {
+	return newWalCacheWithLog(NewLog(opt.initialLogSize, opt.initialIndexSize), opt)
+}
+
+// newWalCacheWithLog is the only place a walCache is built, so every shard gets the same options whether it is new, restored or opened.
+func newWalCacheWithLog(log *Log, opt *walmapOpt) *walCache {
+	if opt.orderedIndex {
+		log.enableOrdered()
+	}
 	return &walCache{
-		log:     NewLog(opt.initialLogSize, opt.initialIndexSize),
+		log:     log,
 		bufPool: opt.bufferPool,
 	}
 }
@@ -1,7 +1,9 @@
 package codec
 
 import (
+	"bytes"
 	"encoding/binary"
+	"hash/crc32"
 	"io"
 	"unsafe"
 
@@ -11,33 +13,119 @@ import (
 const (
 	headerKeySize  uint64 = 8
 	headerDataSize uint64 = 8
+	headerFlag     uint64 = 1
+	headerExpireAt uint64 = 8
+	headerChecksum uint64 = 4
 
-	HeaderSize uint64 = headerKeySize + headerDataSize
+	HeaderSize uint64 = headerKeySize + headerDataSize + headerFlag + headerExpireAt + headerChecksum
+)
+
+const (
+	// MaxKeySize and MaxDataSize bound what Decode allocates for a single record
+	MaxKeySize  uint64 = 1 * 1024 * 1024
+	MaxDataSize uint64 = 1 * 1024 * 1024 * 1024
+)
+
+const (
+	// readChunkSize is the largest buffer allocated for a key or data before it is read
+	readChunkSize uint64 = 64 * 1024
+)
+
+var (
+	ErrCorruptRecord  = errors.New("corrupt record")
+	ErrRecordTooLarge = errors.New("record too large")
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
 )
 
 type Index uint64
 
+type Flag uint8
+
+const (
+	FlagNone      Flag = 0
+	FlagTombstone Flag = 1 << 0
+	FlagRaw       Flag = 1 << 1 // data is stored as is, without value codec
+)
+
 type Header struct {
 	KeySize  uint64
 	DataSize uint64
+	Flag     Flag
+	ExpireAt int64 // unix nano, 0 means no expiry
+	Checksum uint32
+}
+
+func (h Header) IsTombstone() bool {
+	return h.Flag&FlagTombstone != 0
+}
+
+func (h Header) IsRaw() bool {
+	return h.Flag&FlagRaw != 0
+}
+
+func (h Header) IsExpired(now int64) bool {
+	return h.ExpireAt != 0 && h.ExpireAt <= now
+}
+
+// Checksum returns CRC32C of the record: header fields (except checksum itself), key and data.
+func Checksum(header Header, key string, data []byte) uint32 {
+	buf := [HeaderSize]byte{}
+	putHeader(buf[:], header)
+	crc := crc32.Update(0, crcTable, buf[:HeaderSize-headerChecksum])
+	crc = crc32.Update(crc, crcTable, b(key))
+	crc = crc32.Update(crc, crcTable, data)
+	return crc
+}
+
+func putHeader(buf []byte, header Header) {
+	binary.BigEndian.PutUint64(buf[0:], header.KeySize)
+	binary.BigEndian.PutUint64(buf[headerKeySize:], header.DataSize)
+	buf[headerKeySize+headerDataSize] = uint8(header.Flag)
+	binary.BigEndian.PutUint64(buf[headerKeySize+headerDataSize+headerFlag:], uint64(header.ExpireAt))
+	binary.BigEndian.PutUint32(buf[headerKeySize+headerDataSize+headerFlag+headerExpireAt:], header.Checksum)
 }
 
 func EncodeHeader(w io.Writer, header Header) error {
-	if err := binary.Write(w, binary.BigEndian, header.KeySize); err != nil {
-		return errors.WithStack(err)
-	}
-	if err := binary.Write(w, binary.BigEndian, header.DataSize); err != nil {
+	buf := [HeaderSize]byte{}
+	putHeader(buf[:], header)
+	if _, err := w.Write(buf[:]); err != nil {
 		return errors.WithStack(err)
 	}
 	return nil
 }
 
 func Encode(w io.Writer, prev Index, key string, data []byte) (Index, error) {
+	return EncodeWithFlag(w, prev, FlagNone, key, data)
+}
+
+// EncodeTombstone writes a record marking key as deleted.
+func EncodeTombstone(w io.Writer, prev Index, key string) (Index, error) {
+	return EncodeWithFlag(w, prev, FlagTombstone, key, nil)
+}
+
+func EncodeWithFlag(w io.Writer, prev Index, flag Flag, key string, data []byte) (Index, error) {
+	return EncodeRecord(w, prev, Header{Flag: flag}, key, data)
+}
+
+// EncodeRecord writes a record with the flag and expiry of header, sizes and checksum are computed from key and data.
+func EncodeRecord(w io.Writer, prev Index, header Header, key string, data []byte) (Index, error) {
 	keySize := uint64(len(key))
 	dataSize := uint64(len(data))
+	if MaxKeySize < keySize {
+		return 0, errors.Wrapf(ErrRecordTooLarge, "key size %d > %d", keySize, MaxKeySize)
+	}
+	if MaxDataSize < dataSize {
+		return 0, errors.Wrapf(ErrRecordTooLarge, "data size %d > %d", dataSize, MaxDataSize)
+	}
 	next := Index(uint64(prev) + HeaderSize + keySize + dataSize)
 
-	if err := EncodeHeader(w, Header{keySize, dataSize}); err != nil {
+	header.KeySize = keySize
+	header.DataSize = dataSize
+	header.Checksum = Checksum(header, key, data)
+	if err := EncodeHeader(w, header); err != nil {
 		return 0, errors.WithStack(err)
 	}
 
@@ -51,41 +139,139 @@ func Encode(w io.Writer, prev Index, key string, data []byte) (Index, error) {
 	return next, nil
 }
 
+// DecodeHeader reads a record header, rejecting sizes over MaxKeySize / MaxDataSize as ErrCorruptRecord.
 func DecodeHeader(r io.Reader) (Header, error) {
-	keySize, err := readUint64(r)
-	if err != nil {
+	buf := [HeaderSize]byte{}
+	// io.EOF only when r ends right at a record boundary
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
 		return Header{}, errors.WithStack(err)
 	}
-	dataSize, err := readUint64(r)
-	if err != nil {
-		return Header{}, errors.WithStack(err)
+	header := Header{
+		KeySize:  binary.BigEndian.Uint64(buf[0:]),
+		DataSize: binary.BigEndian.Uint64(buf[headerKeySize:]),
+		Flag:     Flag(buf[headerKeySize+headerDataSize]),
+		ExpireAt: int64(binary.BigEndian.Uint64(buf[headerKeySize+headerDataSize+headerFlag:])),
+		Checksum: binary.BigEndian.Uint32(buf[headerKeySize+headerDataSize+headerFlag+headerExpireAt:]),
+	}
+	if MaxKeySize < header.KeySize {
+		return Header{}, errors.Wrapf(ErrCorruptRecord, "key size %d > %d", header.KeySize, MaxKeySize)
+	}
+	if MaxDataSize < header.DataSize {
+		return Header{}, errors.Wrapf(ErrCorruptRecord, "data size %d > %d", header.DataSize, MaxDataSize)
 	}
-	return Header{keySize, dataSize}, nil
+	return header, nil
 }
 
 func Decode(r io.Reader) (string, []byte, error) {
+	_, key, data, err := DecodeRecord(r)
+	if err != nil {
+		return "", nil, errors.WithStack(err)
+	}
+	return key, data, nil
+}
+
+// DecodeRecord is like Decode but also returns the record header, e.g. to tell tombstones apart.
+func DecodeRecord(r io.Reader) (Header, string, []byte, error) {
 	header, err := DecodeHeader(r)
 	if err != nil {
+		return Header{}, "", nil, errors.WithStack(err)
+	}
+
+	key, err := readBytes(r, header.KeySize)
+	if err != nil {
+		return Header{}, "", nil, errors.WithStack(err)
+	}
+	data, err := readBytes(r, header.DataSize)
+	if err != nil {
+		return Header{}, "", nil, errors.WithStack(err)
+	}
+	if sum := Checksum(header, str(key), data); sum != header.Checksum {
+		return Header{}, "", nil, errors.Wrapf(ErrCorruptRecord, "checksum mismatch: expect %08x actual %08x", header.Checksum, sum)
+	}
+	return header, str(key), data, nil
+}
+
+// DecodeView decodes the record at the head of buf without copying, key and data point into buf.
+// it returns io.ErrUnexpectedEOF when buf ends in the middle of the record and ErrCorruptRecord when it is damaged.
+func DecodeView(buf []byte) (Header, []byte, []byte, error) {
+	if uint64(len(buf)) < HeaderSize {
+		return Header{}, nil, nil, errors.WithStack(io.ErrUnexpectedEOF)
+	}
+	header, err := DecodeHeader(bytes.NewReader(buf))
+	if err != nil {
+		return Header{}, nil, nil, errors.WithStack(err)
+	}
+	size := HeaderSize + header.KeySize + header.DataSize
+	if uint64(len(buf)) < size {
+		return Header{}, nil, nil, errors.WithStack(io.ErrUnexpectedEOF)
+	}
+	key := buf[HeaderSize : HeaderSize+header.KeySize]
+	data := buf[HeaderSize+header.KeySize : size]
+	if sum := Checksum(header, str(key), data); sum != header.Checksum {
+		return Header{}, nil, nil, errors.Wrapf(ErrCorruptRecord, "checksum mismatch: expect %08x actual %08x", header.Checksum, sum)
+	}
+	return header, key, data, nil
+}
+
+// Verify checks the record at the head of buf and returns its encoded size.
+// it returns io.ErrUnexpectedEOF when buf ends in the middle of the record and ErrCorruptRecord when it is damaged.
+func Verify(buf []byte) (uint64, error) {
+	header, _, _, err := DecodeView(buf)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return HeaderSize + header.KeySize + header.DataSize, nil
+}
+
+// DecodeLegacy decodes a record of the format written up to v1.1.1, which has neither flag nor checksum.
+func DecodeLegacy(r io.Reader) (string, []byte, error) {
+	buf := [headerKeySize + headerDataSize]byte{}
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
 		return "", nil, errors.WithStack(err)
 	}
+	keySize := binary.BigEndian.Uint64(buf[0:])
+	dataSize := binary.BigEndian.Uint64(buf[headerKeySize:])
+	if MaxKeySize < keySize {
+		return "", nil, errors.Wrapf(ErrCorruptRecord, "key size %d > %d", keySize, MaxKeySize)
+	}
+	if MaxDataSize < dataSize {
+		return "", nil, errors.Wrapf(ErrCorruptRecord, "data size %d > %d", dataSize, MaxDataSize)
+	}
 
-	key := make([]byte, header.KeySize)
-	if _, err := r.Read(key); err != nil {
+	key, err := readBytes(r, keySize)
+	if err != nil {
 		return "", nil, errors.WithStack(err)
 	}
-	data := make([]byte, header.DataSize)
-	if _, err := r.Read(data); err != nil {
+	data, err := readBytes(r, dataSize)
+	if err != nil {
 		return "", nil, errors.WithStack(err)
 	}
 	return str(key), data, nil
 }
 
-func readUint64(r io.Reader) (uint64, error) {
-	u64Buf := make([]byte, 8)
-	if _, err := r.Read(u64Buf); err != nil {
-		return 0, errors.WithStack(err)
+// readBytes reads the rest of a record whose header has been read, so running out of input is io.ErrUnexpectedEOF.
+// sizes are not verified until the checksum, so above readChunkSize the buffer grows as the data arrives
+// instead of allocating a damaged size up front.
+func readBytes(r io.Reader, size uint64) ([]byte, error) {
+	if size <= readChunkSize {
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, errors.WithStack(io.ErrUnexpectedEOF)
+			}
+			return nil, errors.WithStack(err)
+		}
+		return data, nil
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, readChunkSize))
+	if _, err := io.CopyN(buf, r, int64(size)); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.WithStack(io.ErrUnexpectedEOF)
+		}
+		return nil, errors.WithStack(err)
 	}
-	return binary.BigEndian.Uint64(u64Buf), nil
+	return buf.Bytes(), nil
 }
 
 func b(s string) []byte {
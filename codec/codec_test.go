@@ -2,7 +2,14 @@ package codec
 
 import (
 	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"runtime"
 	"testing"
+	"testing/iotest"
+
+	"github.com/pkg/errors"
 )
 
 func TestEncodeDecode(t *testing.T) {
@@ -93,3 +100,300 @@ func TestDecodeIndex(t *testing.T) {
 		}
 	}
 }
+
+func TestEncodeDecodeTombstone(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	index1 := Index(0)
+	index2, err := Encode(buf, index1, "hello", []byte("world"))
+	if err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if _, err := EncodeTombstone(buf, index2, "hello"); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+
+	r := bytes.NewReader(buf.Bytes())
+	header1, key1, data1, err := DecodeRecord(r)
+	if err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if header1.IsTombstone() {
+		t.Errorf("not tombstone")
+	}
+	if key1 != "hello" {
+		t.Errorf("key actual:%s", key1)
+	}
+	if bytes.Equal(data1, []byte("world")) != true {
+		t.Errorf("data actual:%v", data1)
+	}
+
+	header2, key2, data2, err := DecodeRecord(r)
+	if err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if header2.IsTombstone() != true {
+		t.Errorf("tombstone")
+	}
+	if key2 != "hello" {
+		t.Errorf("key actual:%s", key2)
+	}
+	if len(data2) != 0 {
+		t.Errorf("data actual:%v", data2)
+	}
+}
+
+func TestEncodeDecodeExpire(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	if _, err := EncodeRecord(buf, Index(0), Header{ExpireAt: 100}, "hello", []byte("world")); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+
+	header, key, data, err := DecodeRecord(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if header.ExpireAt != 100 {
+		t.Errorf("expire actual:%d", header.ExpireAt)
+	}
+	if header.IsExpired(99) {
+		t.Errorf("not expired")
+	}
+	if header.IsExpired(100) != true {
+		t.Errorf("expired")
+	}
+	if key != "hello" || bytes.Equal(data, []byte("world")) != true {
+		t.Errorf("actual:%s %v", key, data)
+	}
+
+	corrupt := buf.Bytes()
+	corrupt[17] ^= 0xff // expire is covered by the checksum
+	if _, _, _, err := DecodeRecord(bytes.NewReader(corrupt)); errors.Is(err, ErrCorruptRecord) != true {
+		t.Errorf("corrupt actual:%+v", err)
+	}
+}
+
+func TestDecodeCorrupt(t *testing.T) {
+	encoded := func(t *testing.T) []byte {
+		buf := bytes.NewBuffer(nil)
+		if _, err := Encode(buf, Index(0), "hello", []byte("world")); err != nil {
+			t.Fatalf("no error: %+v", err)
+		}
+		return buf.Bytes()
+	}
+
+	t.Run("flip/key", func(tt *testing.T) {
+		data := encoded(tt)
+		data[HeaderSize] ^= 0xff
+		if _, _, err := Decode(bytes.NewReader(data)); errors.Is(err, ErrCorruptRecord) != true {
+			tt.Errorf("corrupt: %+v", err)
+		}
+	})
+	t.Run("flip/data", func(tt *testing.T) {
+		data := encoded(tt)
+		data[len(data)-1] ^= 0x01
+		if _, _, err := Decode(bytes.NewReader(data)); errors.Is(err, ErrCorruptRecord) != true {
+			tt.Errorf("corrupt: %+v", err)
+		}
+	})
+	t.Run("flip/flag", func(tt *testing.T) {
+		data := encoded(tt)
+		data[headerKeySize+headerDataSize] ^= 0x01
+		if _, _, err := Decode(bytes.NewReader(data)); errors.Is(err, ErrCorruptRecord) != true {
+			tt.Errorf("corrupt: %+v", err)
+		}
+	})
+	t.Run("huge/datasize", func(tt *testing.T) {
+		data := encoded(tt)
+		binary.BigEndian.PutUint64(data[headerKeySize:], math.MaxUint64)
+		if _, _, err := Decode(bytes.NewReader(data)); errors.Is(err, ErrCorruptRecord) != true {
+			tt.Errorf("corrupt: %+v", err)
+		}
+	})
+	t.Run("huge/keysize", func(tt *testing.T) {
+		data := encoded(tt)
+		binary.BigEndian.PutUint64(data[0:], MaxKeySize+1)
+		if _, _, err := Decode(bytes.NewReader(data)); errors.Is(err, ErrCorruptRecord) != true {
+			tt.Errorf("corrupt: %+v", err)
+		}
+	})
+}
+
+func TestEncodeTooLarge(t *testing.T) {
+	key := string(make([]byte, MaxKeySize+1))
+	if _, err := Encode(bytes.NewBuffer(nil), Index(0), key, nil); errors.Is(err, ErrRecordTooLarge) != true {
+		t.Errorf("too large: %+v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	next, err := Encode(buf, Index(0), "hello", []byte("world"))
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	data := buf.Bytes()
+
+	size, err := Verify(data)
+	if err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if size != uint64(next) {
+		t.Errorf("actual: %d", size)
+	}
+	if _, err := Verify(data[:HeaderSize-1]); errors.Is(err, io.ErrUnexpectedEOF) != true {
+		t.Errorf("torn header: %+v", err)
+	}
+	if _, err := Verify(data[:len(data)-1]); errors.Is(err, io.ErrUnexpectedEOF) != true {
+		t.Errorf("torn data: %+v", err)
+	}
+	data[len(data)-1] ^= 0xff
+	if _, err := Verify(data); errors.Is(err, ErrCorruptRecord) != true {
+		t.Errorf("corrupt: %+v", err)
+	}
+}
+
+func TestDecodeView(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	if _, err := EncodeWithFlag(buf, Index(0), FlagRaw, "hello", []byte("world")); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+
+	header, key, data, err := DecodeView(buf.Bytes())
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	if header.IsRaw() != true {
+		t.Errorf("raw flag")
+	}
+	if string(key) != "hello" {
+		t.Errorf("key actual:%s", key)
+	}
+	if bytes.Equal(data, []byte("world")) != true {
+		t.Errorf("data actual:%v", data)
+	}
+	if &data[0] != &buf.Bytes()[HeaderSize+5] {
+		t.Errorf("must not copy")
+	}
+}
+
+func TestDecodeShortRead(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	index := Index(0)
+	records := []struct {
+		key  string
+		data []byte
+	}{
+		{"hello", []byte("world")},
+		{"empty", []byte{}},
+		{"large", bytes.Repeat([]byte("x"), 4096)},
+	}
+	for _, r := range records {
+		next, err := Encode(buf, index, r.key, r.data)
+		if err != nil {
+			t.Fatalf("no error: %+v", err)
+		}
+		index = next
+	}
+	if _, err := EncodeTombstone(buf, index, "hello"); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+
+	t.Run("one byte reader", func(tt *testing.T) {
+		r := iotest.OneByteReader(bytes.NewReader(buf.Bytes()))
+		for _, expect := range records {
+			key, data, err := Decode(r)
+			if err != nil {
+				tt.Fatalf("no error: %+v", err)
+			}
+			if key != expect.key || bytes.Equal(data, expect.data) != true {
+				tt.Errorf("actual: %s %d bytes", key, len(data))
+			}
+		}
+		header, key, _, err := DecodeRecord(r)
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if header.IsTombstone() != true || key != "hello" {
+			tt.Errorf("actual: %s %v", key, header)
+		}
+		if _, _, err := Decode(r); errors.Is(err, io.EOF) != true {
+			tt.Errorf("io.EOF at the end: %+v", err)
+		}
+	})
+	t.Run("truncated", func(tt *testing.T) {
+		// every prefix either ends at a record boundary (io.EOF) or in the middle of one (io.ErrUnexpectedEOF)
+		for size := 0; size < buf.Len(); size += 1 {
+			r := iotest.OneByteReader(bytes.NewReader(buf.Bytes()[:size]))
+			for {
+				_, _, _, err := DecodeRecord(r)
+				if err == nil {
+					continue
+				}
+				if errors.Is(err, io.EOF) != true && errors.Is(err, io.ErrUnexpectedEOF) != true {
+					tt.Fatalf("size=%d unexpected error: %+v", size, err)
+				}
+				break
+			}
+		}
+		r := iotest.OneByteReader(bytes.NewReader(buf.Bytes()[:HeaderSize+2]))
+		if _, _, err := Decode(r); errors.Is(err, io.ErrUnexpectedEOF) != true {
+			tt.Errorf("short key: %+v", err)
+		}
+		r = iotest.OneByteReader(bytes.NewReader(buf.Bytes()[:HeaderSize-1]))
+		if _, _, err := Decode(r); errors.Is(err, io.ErrUnexpectedEOF) != true {
+			tt.Errorf("short header: %+v", err)
+		}
+	})
+	t.Run("legacy", func(tt *testing.T) {
+		legacy := bytes.NewBuffer(nil)
+		binary.Write(legacy, binary.BigEndian, uint64(5))
+		binary.Write(legacy, binary.BigEndian, uint64(5))
+		legacy.WriteString("helloworld")
+
+		key, data, err := DecodeLegacy(iotest.OneByteReader(bytes.NewReader(legacy.Bytes())))
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if key != "hello" || string(data) != "world" {
+			tt.Errorf("actual: %s %s", key, data)
+		}
+		if _, _, err := DecodeLegacy(iotest.OneByteReader(bytes.NewReader(legacy.Bytes()[:19]))); errors.Is(err, io.ErrUnexpectedEOF) != true {
+			tt.Errorf("short data: %+v", err)
+		}
+	})
+}
+
+func TestDecodeDamagedSize(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	if _, err := Encode(buf, 0, "key", []byte("value")); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	damaged := bytes.Clone(buf.Bytes())
+	binary.BigEndian.PutUint64(damaged[headerKeySize:], MaxDataSize)
+
+	before := runtime.MemStats{}
+	runtime.ReadMemStats(&before)
+	if _, _, err := Decode(bytes.NewReader(damaged)); errors.Is(err, io.ErrUnexpectedEOF) != true {
+		t.Errorf("actual: %+v", err)
+	}
+	after := runtime.MemStats{}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; 1*1024*1024 < allocated {
+		t.Errorf("allocated for the damaged size: %d bytes", allocated)
+	}
+
+	t.Run("large", func(tt *testing.T) {
+		data := bytes.Repeat([]byte("0123456789"), int(readChunkSize)/2)
+		out := bytes.NewBuffer(nil)
+		if _, err := Encode(out, 0, "large", data); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		key, decoded, err := Decode(iotest.OneByteReader(bytes.NewReader(out.Bytes())))
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if key != "large" || bytes.Equal(decoded, data) != true {
+			tt.Errorf("actual: %s %d bytes", key, len(decoded))
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package walmap
+
+import (
+	"time"
+)
+
+const (
+	defaultCompactInterval    time.Duration = time.Second
+	defaultCompactConcurrency int           = 1
+)
+
+// CompactPolicy decides when WithAutoCompact compacts a shard.
+type CompactPolicy struct {
+	ratio       float64
+	reclaimable uint64
+	interval    time.Duration
+	concurrency int
+}
+
+// CompactRatio compacts a shard once its reclaimable space reaches ratio (0 < ratio <= 1) of its size.
+func CompactRatio(ratio float64) CompactPolicy {
+	return CompactPolicy{
+		ratio:       ratio,
+		interval:    defaultCompactInterval,
+		concurrency: defaultCompactConcurrency,
+	}
+}
+
+// CompactReclaimable compacts a shard once its reclaimable space reaches size bytes.
+func CompactReclaimable(size uint64) CompactPolicy {
+	return CompactPolicy{
+		reclaimable: size,
+		interval:    defaultCompactInterval,
+		concurrency: defaultCompactConcurrency,
+	}
+}
+
+// Interval sets how often the shards are checked, every second by default.
+func (p CompactPolicy) Interval(interval time.Duration) CompactPolicy {
+	p.interval = interval
+	return p
+}
+
+// Concurrency sets the number of shards compacted at a time, 1 by default.
+func (p CompactPolicy) Concurrency(n int) CompactPolicy {
+	p.concurrency = n
+	return p
+}
+
+func (p CompactPolicy) enabled() bool {
+	return 0 < p.interval && (0 < p.ratio || 0 < p.reclaimable)
+}
+
+func (p CompactPolicy) needsCompact(reclaimable, size uint64) bool {
+	if reclaimable == 0 {
+		return false
+	}
+	if 0 < p.reclaimable && p.reclaimable <= reclaimable {
+		return true
+	}
+	if 0 < p.ratio && 0 < size && p.ratio <= float64(reclaimable)/float64(size) {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package walmap
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCompactPolicy(t *testing.T) {
+	t.Run("ratio", func(tt *testing.T) {
+		p := CompactRatio(0.5)
+		if p.needsCompact(49, 100) {
+			tt.Errorf("below ratio")
+		}
+		if p.needsCompact(50, 100) != true {
+			tt.Errorf("reached ratio")
+		}
+		if p.needsCompact(0, 0) {
+			tt.Errorf("empty shard")
+		}
+	})
+	t.Run("reclaimable", func(tt *testing.T) {
+		p := CompactReclaimable(1024)
+		if p.needsCompact(1023, 1024*1024) {
+			tt.Errorf("below size")
+		}
+		if p.needsCompact(1024, 1024*1024) != true {
+			tt.Errorf("reached size")
+		}
+	})
+	t.Run("disabled", func(tt *testing.T) {
+		if (CompactPolicy{}).enabled() {
+			tt.Errorf("zero value is disabled")
+		}
+		if CompactRatio(0.5).Interval(0).enabled() {
+			tt.Errorf("no interval is disabled")
+		}
+	})
+}
+
+func TestAutoCompact(t *testing.T) {
+	m := New(WithShardSize(8), WithAutoCompact(CompactRatio(0.1).Interval(5*time.Millisecond).Concurrency(2)))
+	for i := 0; i < 100; i += 1 {
+		m.Set("key"+strconv.Itoa(i), i)
+	}
+	for i := 0; i < 100; i += 2 {
+		m.Remove("key" + strconv.Itoa(i))
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for 0 < m.ReclaimableSpace() {
+		if deadline.Before(time.Now()) {
+			t.Fatalf("not compacted: %d", m.ReclaimableSpace())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if m.Len() != 50 {
+		t.Errorf("actual: %d", m.Len())
+	}
+	if v, ok := m.Get("key1"); ok != true || v.(int) != 1 {
+		t.Errorf("actual: %v %v", v, ok)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+}
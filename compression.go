@@ -0,0 +1,110 @@
+package walmap
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	compressionGzip  uint8 = 1
+	compressionFlate uint8 = 2
+)
+
+// Compression compresses each shard block of a snapshot.
+// the ID is recorded in the snapshot header so that Restore picks the decompressor on its own,
+// IDs below 16 are reserved for the built-in ones. a custom compression (e.g. zstd) must be passed to Restore too.
+type Compression interface {
+	ID() uint8
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+type gzipCompression struct {
+	level int
+}
+
+func (gzipCompression) ID() uint8 {
+	return compressionGzip
+}
+
+func (c gzipCompression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, c.level)
+}
+
+func (gzipCompression) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// GzipCompression compresses with compress/gzip at level (gzip.BestSpeed ... gzip.BestCompression).
+func GzipCompression(level int) Compression {
+	return gzipCompression{level}
+}
+
+type flateCompression struct {
+	level int
+}
+
+func (flateCompression) ID() uint8 {
+	return compressionFlate
+}
+
+func (c flateCompression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, c.level)
+}
+
+func (flateCompression) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+// FlateCompression compresses with compress/flate at level (flate.BestSpeed ... flate.BestCompression).
+func FlateCompression(level int) Compression {
+	return flateCompression{level}
+}
+
+// compressionOf returns the Compression recorded in a snapshot header, nil for an uncompressed snapshot.
+func compressionOf(id uint8, opt *walmapOpt) (Compression, error) {
+	switch {
+	case id == compressionNone:
+		return nil, nil
+	case opt.compression != nil && opt.compression.ID() == id:
+		return opt.compression, nil
+	case id == compressionGzip:
+		return GzipCompression(gzip.DefaultCompression), nil
+	case id == compressionFlate:
+		return FlateCompression(flate.DefaultCompression), nil
+	}
+	return nil, errors.Wrapf(ErrUnsupportedSnapshot, "unknown compression %d", id)
+}
+
+func compressBlock(w io.Writer, c Compression, data []byte) error {
+	cw, err := c.NewWriter(w)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := cw.Write(data); err != nil {
+		cw.Close()
+		return errors.WithStack(err)
+	}
+	if err := cw.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func decompressBlock(c Compression, data []byte) ([]byte, error) {
+	cr, err := c.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer cr.Close()
+
+	decompressed, err := io.ReadAll(cr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return decompressed, nil
+}
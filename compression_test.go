@@ -0,0 +1,90 @@
+package walmap
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+type testCustomCompression struct {
+	Compression
+}
+
+func (testCustomCompression) ID() uint8 {
+	return 0x80
+}
+
+func TestSnapshotCompression(t *testing.T) {
+	m := New(WithShardSize(8))
+	for i := 0; i < 1000; i += 1 {
+		m.Set("key"+strconv.Itoa(i), strings.Repeat("text-heavy value ", 10))
+	}
+	plain := bytes.NewBuffer(nil)
+	if err := m.Snapshot(plain); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+
+	snapshot := func(tt *testing.T, funcs ...walmapOptFunc) *bytes.Buffer {
+		c := New(append([]walmapOptFunc{WithShardSize(8)}, funcs...)...)
+		for i := 0; i < 1000; i += 1 {
+			c.Set("key"+strconv.Itoa(i), strings.Repeat("text-heavy value ", 10))
+		}
+		out := bytes.NewBuffer(nil)
+		if err := c.Snapshot(out); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		return out
+	}
+	verify := func(tt *testing.T, out *bytes.Buffer, funcs ...walmapOptFunc) {
+		r, err := Restore(out, append([]walmapOptFunc{WithShardSize(8)}, funcs...)...)
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if r.Len() != 1000 {
+			tt.Errorf("actual: %d", r.Len())
+		}
+		if v, ok := r.Get("key999"); ok != true || v.(string) != strings.Repeat("text-heavy value ", 10) {
+			tt.Errorf("actual: %v %v", v, ok)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		compression Compression
+	}{
+		{"gzip", GzipCompression(gzip.BestSpeed)},
+		{"flate", FlateCompression(flate.BestCompression)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(tt *testing.T) {
+			out := snapshot(tt, WithSnapshotCompression(tc.compression))
+			if plain.Len() <= out.Len() {
+				tt.Errorf("not compressed: plain=%d compressed=%d", plain.Len(), out.Len())
+			}
+			// Restore detects the compression from the header
+			verify(tt, out)
+		})
+	}
+	t.Run("concurrency", func(tt *testing.T) {
+		out := snapshot(tt, WithSnapshotCompression(GzipCompression(gzip.DefaultCompression)), WithConcurrency(3))
+		verify(tt, out, WithConcurrency(3))
+	})
+	t.Run("consistent", func(tt *testing.T) {
+		out := snapshot(tt, WithSnapshotCompression(GzipCompression(gzip.DefaultCompression)), WithConsistentSnapshot())
+		verify(tt, out)
+	})
+	t.Run("custom", func(tt *testing.T) {
+		custom := testCustomCompression{FlateCompression(flate.BestSpeed)}
+		out := snapshot(tt, WithSnapshotCompression(custom))
+
+		if _, err := Restore(bytes.NewReader(out.Bytes()), WithShardSize(8)); errors.Is(err, ErrUnsupportedSnapshot) != true {
+			tt.Errorf("custom compression must be given to Restore: %+v", err)
+		}
+		verify(tt, out, WithSnapshotCompression(custom))
+	})
+}
@@ -0,0 +1,249 @@
+package walmap
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	snapshotFlagDelta uint16 = 1 << 1
+)
+
+const (
+	deltaAppend uint8 = 0 // the records appended since the token, replayed onto the shard
+	deltaFull   uint8 = 1 // the whole log, the shard was compacted or is not known to the token
+)
+
+var (
+	ErrDeltaMismatch = errors.New("delta does not match the map")
+	ErrInvalidToken  = errors.New("invalid snapshot token")
+)
+
+type shardPosition struct {
+	generation uint64
+	offset     uint64
+}
+
+// SnapshotToken is the position of every shard's log at the time of a snapshot, the zero value means no previous snapshot.
+type SnapshotToken struct {
+	positions []shardPosition
+}
+
+// MarshalBinary encodes the token so that it can be kept along with the snapshot.
+func (t SnapshotToken) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 8+len(t.positions)*16)
+	binary.BigEndian.PutUint64(buf, uint64(len(t.positions)))
+	for i, p := range t.positions {
+		binary.BigEndian.PutUint64(buf[8+i*16:], p.generation)
+		binary.BigEndian.PutUint64(buf[8+i*16+8:], p.offset)
+	}
+	return buf, nil
+}
+
+func (t *SnapshotToken) UnmarshalBinary(data []byte) error {
+	if len(data) < 8 {
+		return errors.Wrapf(ErrInvalidToken, "%d bytes", len(data))
+	}
+	size := binary.BigEndian.Uint64(data)
+	rest := uint64(len(data) - 8)
+	// size*16 could overflow, compare against rest/16 instead
+	if size != rest/16 || rest%16 != 0 {
+		return errors.Wrapf(ErrInvalidToken, "%d bytes for %d shards", len(data), size)
+	}
+	positions := make([]shardPosition, size)
+	for i := range positions {
+		positions[i].generation = binary.BigEndian.Uint64(data[8+i*16:])
+		positions[i].offset = binary.BigEndian.Uint64(data[8+i*16+8:])
+	}
+	t.positions = positions
+	return nil
+}
+
+// equal reports whether t and other are the positions of the same snapshot.
+func (t SnapshotToken) equal(other SnapshotToken) bool {
+	if len(t.positions) != len(other.positions) {
+		return false
+	}
+	for i, p := range t.positions {
+		if p != other.positions[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func encodeToken(w io.Writer, token SnapshotToken) error {
+	data, err := token.MarshalBinary()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := encodeData(w, data); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func decodeToken(r io.Reader) (SnapshotToken, error) {
+	data, err := decodeData(r)
+	if err != nil {
+		return SnapshotToken{}, errors.WithStack(err)
+	}
+	token := SnapshotToken{}
+	if err := token.UnmarshalBinary(data); err != nil {
+		return SnapshotToken{}, errors.WithStack(err)
+	}
+	return token, nil
+}
+
+// capturePositions takes the generation and records of every shard's log, at the same instant when consistent is set.
+func (s *shards) capturePositions(consistent bool) ([]uint64, [][]byte) {
+	generations := make([]uint64, len(s.caches))
+	logs := make([][]byte, len(s.caches))
+	if consistent {
+		for _, cache := range s.caches {
+			cache.RLock()
+		}
+		defer func() {
+			for _, cache := range s.caches {
+				cache.RUnlock()
+			}
+		}()
+	}
+	for i, cache := range s.caches {
+		generations[i], logs[i] = cache.log.position()
+	}
+	return generations, logs
+}
+
+// SnapshotSince writes the records appended to each shard since token, or the whole log of the shards
+// compacted meanwhile, and returns the token of this snapshot. a zero token writes every shard in full.
+func (s *shards) SnapshotSince(w io.Writer, since SnapshotToken, opt *walmapOpt) (SnapshotToken, error) {
+	generations, logs := s.capturePositions(opt.consistent)
+
+	known := len(since.positions) == len(s.caches)
+	kinds := make([]byte, len(s.caches))
+	blocks := make([][]byte, len(s.caches))
+	token := SnapshotToken{make([]shardPosition, len(s.caches))}
+	for i := range s.caches {
+		token.positions[i] = shardPosition{generations[i], uint64(len(logs[i]))}
+
+		kinds[i] = deltaFull
+		blocks[i] = logs[i]
+		if known {
+			prev := since.positions[i]
+			if prev.generation == generations[i] && prev.offset <= uint64(len(logs[i])) {
+				kinds[i] = deltaAppend
+				blocks[i] = logs[i][prev.offset:]
+			}
+		}
+	}
+
+	header := newSnapshotHeader(s)
+	header.Flags |= snapshotFlagDelta
+	if opt.compression != nil {
+		header.Compression = opt.compression.ID()
+	}
+	if err := encodeSnapshotHeader(w, header); err != nil {
+		return SnapshotToken{}, errors.WithStack(err)
+	}
+	// since and token let ApplyDelta check that deltas are applied in order
+	if err := encodeToken(w, since); err != nil {
+		return SnapshotToken{}, errors.WithStack(err)
+	}
+	if err := encodeToken(w, token); err != nil {
+		return SnapshotToken{}, errors.WithStack(err)
+	}
+	if err := encodeData(w, kinds); err != nil {
+		return SnapshotToken{}, errors.WithStack(err)
+	}
+	if err := s.encodeBlocks(w, opt, func(i int) []byte {
+		return blocks[i]
+	}); err != nil {
+		return SnapshotToken{}, errors.WithStack(err)
+	}
+	return token, nil
+}
+
+// ApplyDelta layers a snapshot written by SnapshotSince onto the shards, which must have the shard size and hash function of the snapshot.
+// applied is the token of the last delta applied to the shards, the delta must have been taken since it
+// unless it was taken with a zero token. it returns the token to be passed as applied to the next delta: the token of
+// this delta, applied as is when it is refused before any shard is modified, or a zero token when it fails partway.
+func (s *shards) ApplyDelta(r io.Reader, applied SnapshotToken, opt *walmapOpt) (SnapshotToken, error) {
+	header, err := decodeSnapshotHeader(r)
+	if err != nil {
+		return applied, errors.WithStack(err)
+	}
+	if header.hasFlag(snapshotFlagDelta) != true {
+		return applied, errors.Wrap(ErrDeltaMismatch, "not a delta snapshot, use Restore")
+	}
+	if header.ValueCodec != s.valueCodecID {
+		return applied, errors.Wrapf(ErrValueCodecMismatch, "snapshot %d, current %d", header.ValueCodec, s.valueCodecID)
+	}
+	if header.HashFuncID != hashFuncID(s.hash) {
+		return applied, errors.Wrapf(ErrHashFuncMismatch, "snapshot %016x, current %016x", header.HashFuncID, hashFuncID(s.hash))
+	}
+	if header.ShardSize != s.size {
+		return applied, errors.Wrapf(ErrDeltaMismatch, "snapshot %d shards, current %d", header.ShardSize, s.size)
+	}
+	compression, err := compressionOf(header.Compression, opt)
+	if err != nil {
+		return applied, errors.WithStack(err)
+	}
+
+	since, err := decodeToken(r)
+	if err != nil {
+		return applied, errors.WithStack(err)
+	}
+	token, err := decodeToken(r)
+	if err != nil {
+		return applied, errors.WithStack(err)
+	}
+	if uint64(len(token.positions)) != s.size {
+		return applied, errors.Wrapf(ErrInvalidToken, "%d shards in token, header %d", len(token.positions), s.size)
+	}
+	if 0 < len(since.positions) && since.equal(applied) != true {
+		// a delta taken since another snapshot: out of order, skipped or not applied onto this map
+		return applied, errors.Wrap(ErrDeltaMismatch, "delta does not follow the last applied snapshot")
+	}
+
+	kinds, err := decodeData(r)
+	if err != nil {
+		return applied, errors.WithStack(err)
+	}
+	if uint64(len(kinds)) != s.size {
+		return applied, errors.Wrapf(ErrTruncatedSnapshot, "%d shard kinds, header %d", len(kinds), s.size)
+	}
+	for i, kind := range kinds {
+		data, err := decodeData(r)
+		if err != nil {
+			return SnapshotToken{}, errors.Wrapf(err, "shard %d", i)
+		}
+		if compression != nil {
+			decompressed, err := decompressBlock(compression, data)
+			if err != nil {
+				return SnapshotToken{}, errors.Wrapf(err, "shard %d", i)
+			}
+			data = decompressed
+		}
+		if err := s.applyShard(i, kind, data); err != nil {
+			return SnapshotToken{}, errors.Wrapf(err, "shard %d", i)
+		}
+	}
+	return token, nil
+}
+
+func (s *shards) applyShard(i int, kind uint8, data []byte) error {
+	cache := s.caches[i]
+	cache.Lock()
+	defer cache.Unlock()
+
+	switch kind {
+	case deltaAppend:
+		return cache.log.applyRecords(data)
+	case deltaFull:
+		return cache.log.replaceRecords(data)
+	}
+	return errors.Wrapf(ErrUnsupportedSnapshot, "unknown delta kind %d", kind)
+}
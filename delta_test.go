@@ -0,0 +1,236 @@
+package walmap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func testSameContent(t *testing.T, expect, actual *WALMap) {
+	expectKeys := expect.Keys()
+	actualKeys := actual.Keys()
+	sort.Strings(expectKeys)
+	sort.Strings(actualKeys)
+	if len(expectKeys) != len(actualKeys) {
+		t.Fatalf("keys expect: %d actual: %d", len(expectKeys), len(actualKeys))
+	}
+	for i, key := range expectKeys {
+		if actualKeys[i] != key {
+			t.Fatalf("key expect: %s actual: %s", key, actualKeys[i])
+		}
+		v1, _ := expect.Get(key)
+		v2, _ := actual.Get(key)
+		if reflect.DeepEqual(v1, v2) != true {
+			t.Errorf("%s expect: %v actual: %v", key, v1, v2)
+		}
+	}
+}
+
+func TestSnapshotSince(t *testing.T) {
+	src := New(WithShardSize(8))
+	for i := 0; i < 1000; i += 1 {
+		src.Set("key"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	dst := New(WithShardSize(8))
+
+	base := bytes.NewBuffer(nil)
+	token, err := src.SnapshotSince(base, SnapshotToken{})
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	baseSize := base.Len()
+	if err := dst.ApplyDelta(base); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	testSameContent(t, src, dst)
+
+	t.Run("delta", func(tt *testing.T) {
+		src.Set("key1", "updated")
+		src.Set("new", "value")
+		src.Remove("key2")
+
+		delta := bytes.NewBuffer(nil)
+		next, err := src.SnapshotSince(delta, token)
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		token = next
+		if baseSize/10 < delta.Len() {
+			tt.Errorf("delta must only carry the changes: base=%d delta=%d", baseSize, delta.Len())
+		}
+		if err := dst.ApplyDelta(delta); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		testSameContent(tt, src, dst)
+		if _, ok := dst.Get("key2"); ok {
+			tt.Errorf("removed key must be removed")
+		}
+	})
+	t.Run("compacted", func(tt *testing.T) {
+		for i := 3; i < 500; i += 1 {
+			src.Remove("key" + strconv.Itoa(i))
+		}
+		if err := src.Compact(); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		src.Set("after", "compact")
+
+		delta := bytes.NewBuffer(nil)
+		next, err := src.SnapshotSince(delta, token)
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		token = next
+		if err := dst.ApplyDelta(delta); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		testSameContent(tt, src, dst)
+	})
+	t.Run("token", func(tt *testing.T) {
+		data, err := token.MarshalBinary()
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		decoded := SnapshotToken{}
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		src.Set("marshal", "token")
+
+		delta := bytes.NewBuffer(nil)
+		if _, err := src.SnapshotSince(delta, decoded); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if err := dst.ApplyDelta(delta); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		testSameContent(tt, src, dst)
+
+		if err := decoded.UnmarshalBinary(data[:len(data)-1]); errors.Is(err, ErrInvalidToken) != true {
+			tt.Errorf("invalid token: %+v", err)
+		}
+		// 0x10 << 56 shards, size*16 overflows to 0
+		if err := decoded.UnmarshalBinary([]byte{0x10, 0, 0, 0, 0, 0, 0, 0}); errors.Is(err, ErrInvalidToken) != true {
+			tt.Errorf("invalid token: %+v", err)
+		}
+	})
+}
+
+func TestApplyDelta(t *testing.T) {
+	src := New(WithShardSize(4), WithSnapshotCompression(GzipCompression(gzip.BestSpeed)))
+	for i := 0; i < 100; i += 1 {
+		src.Set("key"+strconv.Itoa(i), i)
+	}
+	base := bytes.NewBuffer(nil)
+	token, err := src.SnapshotSince(base, SnapshotToken{})
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+
+	t.Run("durable", func(tt *testing.T) {
+		dir := tt.TempDir()
+		dst, err := Open(dir, WithShardSize(4))
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if err := dst.ApplyDelta(bytes.NewReader(base.Bytes())); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		src.Remove("key0")
+		delta := bytes.NewBuffer(nil)
+		if _, err := src.SnapshotSince(delta, token); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if err := dst.ApplyDelta(delta); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if err := dst.Close(); err != nil {
+			tt.Errorf("no error: %+v", err)
+		}
+
+		reopened, err := Open(dir, WithShardSize(4))
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		defer reopened.Close()
+		testSameContent(tt, src, reopened)
+	})
+	t.Run("mismatch", func(tt *testing.T) {
+		if _, err := Restore(bytes.NewReader(base.Bytes()), WithShardSize(4)); errors.Is(err, ErrUnsupportedSnapshot) != true {
+			tt.Errorf("Restore must refuse delta: %+v", err)
+		}
+
+		full := bytes.NewBuffer(nil)
+		if err := src.Snapshot(full); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if err := New(WithShardSize(4)).ApplyDelta(full); errors.Is(err, ErrDeltaMismatch) != true {
+			tt.Errorf("ApplyDelta must refuse full snapshot: %+v", err)
+		}
+		if err := New(WithShardSize(5)).ApplyDelta(bytes.NewReader(base.Bytes())); errors.Is(err, ErrDeltaMismatch) != true {
+			tt.Errorf("shard size: %+v", err)
+		}
+	})
+}
+
+func TestApplyDeltaOrder(t *testing.T) {
+	src := New(WithShardSize(4))
+	for i := 0; i < 100; i += 1 {
+		src.Set("key"+strconv.Itoa(i), i)
+	}
+	base := bytes.NewBuffer(nil)
+	token, err := src.SnapshotSince(base, SnapshotToken{})
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	src.Set("a", 1)
+	d1 := bytes.NewBuffer(nil)
+	token, err = src.SnapshotSince(d1, token)
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	src.Set("b", 2)
+	d2 := bytes.NewBuffer(nil)
+	if _, err := src.SnapshotSince(d2, token); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+
+	dst := New(WithShardSize(4))
+	defer dst.Close()
+	if err := dst.ApplyDelta(bytes.NewReader(d1.Bytes())); errors.Is(err, ErrDeltaMismatch) != true {
+		t.Errorf("before base: %+v", err)
+	}
+	if err := dst.ApplyDelta(bytes.NewReader(base.Bytes())); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	// d1 skipped
+	if err := dst.ApplyDelta(bytes.NewReader(d2.Bytes())); errors.Is(err, ErrDeltaMismatch) != true {
+		t.Errorf("skipped delta: %+v", err)
+	}
+	if _, ok := dst.Get("b"); ok {
+		t.Errorf("refused delta applied")
+	}
+	if err := dst.ApplyDelta(bytes.NewReader(d1.Bytes())); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	if err := dst.ApplyDelta(bytes.NewReader(d1.Bytes())); errors.Is(err, ErrDeltaMismatch) != true {
+		t.Errorf("applied twice: %+v", err)
+	}
+	if err := dst.ApplyDelta(bytes.NewReader(d2.Bytes())); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	testSameContent(t, src, dst)
+
+	// a zero token delta starts over
+	if err := dst.ApplyDelta(bytes.NewReader(base.Bytes())); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if _, ok := dst.Get("a"); ok {
+		t.Errorf("base replaces the content")
+	}
+}
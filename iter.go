@@ -0,0 +1,86 @@
+package walmap
+
+import (
+	"iter"
+
+	"github.com/octu0/walmap/codec"
+	"github.com/pkg/errors"
+)
+
+// All returns an iterator over the keys and values of the Map, shard by shard in no particular key order.
+//
+// each shard is read locked only while its live keys are collected, values are decoded from the log when they
+// are yielded, so the loop body may read and write the Map. what the loop sees under concurrent writes:
+//   - each shard is seen as it was when the iterator got to it, a shard is never seen half written
+//   - shards are not captured together, so keys in different shards may be seen at different instants
+//   - a key written or removed in a shard after it was captured (even by the loop body) is not reflected
+//   - keys written after a Reshard that started during the iteration may be missed
+//
+// a value that fails to decode is passed to the ErrorHandler and skipped.
+func (c *Map[V]) All() iter.Seq2[string, V] {
+	return func(yield func(string, V) bool) {
+		for _, m := range c.s.Load().Shards() {
+			entries, buf := c.shardEntries(m)
+			for _, e := range entries {
+				value, err := c.decodeAt(buf, e.index)
+				if err != nil {
+					c.opt.errorHandler("All", e.key, err)
+					continue
+				}
+				if yield(e.key, value) != true {
+					return
+				}
+			}
+		}
+	}
+}
+
+// KeysSeq returns an iterator over the keys of the Map, unlike Keys it does not collect every key up front.
+// it sees concurrent writes the same way as All.
+func (c *Map[V]) KeysSeq() iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for _, m := range c.s.Load().Shards() {
+			entries, _ := c.shardEntries(m)
+			for _, e := range entries {
+				if yield(e.key) != true {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Values returns an iterator over the values of the Map, it sees concurrent writes the same way as All.
+func (c *Map[V]) Values() iter.Seq[V] {
+	return func(yield func(V) bool) {
+		for _, value := range c.All() {
+			if yield(value) != true {
+				return
+			}
+		}
+	}
+}
+
+func (c *Map[V]) shardEntries(m *walCache) ([]logEntry, []byte) {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.log.entries()
+}
+
+// decodeAt decodes the value of the record at index of buf.
+// the data is copied first as buf is shared with the log, and a codec (e.g. BytesCodec) or raw data may keep it.
+func (c *Map[V]) decodeAt(buf []byte, index codec.Index) (V, error) {
+	var empty V
+	header, _, view, err := codec.DecodeView(buf[index:])
+	if err != nil {
+		return empty, errors.WithStack(err)
+	}
+	data := make([]byte, len(view))
+	copy(data, view)
+	value, err := decodeValue(c.codec, header, data)
+	if err != nil {
+		return empty, errors.WithStack(err)
+	}
+	return value, nil
+}
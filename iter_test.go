@@ -0,0 +1,147 @@
+package walmap
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIter(t *testing.T) {
+	m := NewMap[int](JSONCodec[int](), WithShardSize(8))
+	defer m.Close()
+	for i := 0; i < 100; i += 1 {
+		m.Set(strconv.Itoa(i), i)
+	}
+	m.Remove("10")
+	m.SetWithTTL("11", 11, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	t.Run("All", func(tt *testing.T) {
+		seen := make(map[string]int)
+		for key, value := range m.All() {
+			if _, ok := seen[key]; ok {
+				tt.Errorf("duplicate key: %s", key)
+			}
+			seen[key] = value
+		}
+		if len(seen) != 98 {
+			tt.Errorf("actual: %d", len(seen))
+		}
+		for key, value := range seen {
+			if key != strconv.Itoa(value) {
+				tt.Errorf("key=%s actual: %d", key, value)
+			}
+		}
+		if _, ok := seen["10"]; ok {
+			tt.Errorf("removed key")
+		}
+		if _, ok := seen["11"]; ok {
+			tt.Errorf("expired key")
+		}
+	})
+	t.Run("KeysSeq", func(tt *testing.T) {
+		n := 0
+		for key := range m.KeysSeq() {
+			if _, ok := m.Get(key); ok != true {
+				tt.Errorf("exists key: %s", key)
+			}
+			n += 1
+		}
+		if n != 98 {
+			tt.Errorf("actual: %d", n)
+		}
+	})
+	t.Run("Values", func(tt *testing.T) {
+		sum := 0
+		for value := range m.Values() {
+			sum += value
+		}
+		if expect := 99*100/2 - 10 - 11; sum != expect {
+			tt.Errorf("expect: %d actual: %d", expect, sum)
+		}
+	})
+	t.Run("break", func(tt *testing.T) {
+		n := 0
+		for range m.All() {
+			n += 1
+			if n == 5 {
+				break
+			}
+		}
+		if n != 5 {
+			tt.Errorf("actual: %d", n)
+		}
+	})
+}
+
+func TestIterWrite(t *testing.T) {
+	m := NewMap[int](JSONCodec[int](), WithShardSize(4))
+	defer m.Close()
+	for i := 0; i < 100; i += 1 {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	// the loop body writes to the shard being walked, which is seen as it was when the iterator got to it
+	n := 0
+	for key, value := range m.All() {
+		if value%2 == 0 {
+			m.Remove(key)
+		} else {
+			m.Set(key, value+1000)
+		}
+		n += 1
+	}
+	if n != 100 {
+		t.Errorf("actual: %d", n)
+	}
+	if m.Len() != 50 {
+		t.Errorf("actual: %d", m.Len())
+	}
+	for i := 1; i < 100; i += 2 {
+		if v, ok := m.Get(strconv.Itoa(i)); ok != true || v != i+1000 {
+			t.Errorf("%d actual: %v %v", i, v, ok)
+		}
+	}
+}
+
+func TestIterBytes(t *testing.T) {
+	t.Run("SetBytes", func(tt *testing.T) {
+		m := New(WithShardSize(2))
+		defer m.Close()
+		m.SetBytes("raw", []byte("hello"))
+
+		for key, value := range m.All() {
+			data, ok := value.([]byte)
+			if ok != true {
+				tt.Fatalf("%s actual: %T", key, value)
+			}
+			// the value is a copy, not the log buffer
+			data[0] = 'j'
+		}
+		if v, ok := m.Get("raw"); ok != true || string(v.([]byte)) != "hello" {
+			tt.Errorf("actual: %v %v", v, ok)
+		}
+	})
+	t.Run("BytesCodec", func(tt *testing.T) {
+		m := NewMap[[]byte](BytesCodec(), WithShardSize(2))
+		defer m.Close()
+		m.Set("foo", []byte("hello"))
+		m.Set("bar", []byte("world"))
+
+		for _, data := range m.All() {
+			data[0] = 'j'
+		}
+		for data := range m.Values() {
+			data[1] = 'j'
+		}
+		for key, expect := range map[string]string{"foo": "hello", "bar": "world"} {
+			v, ok, err := m.GetE(key)
+			if err != nil {
+				tt.Errorf("no error: %+v", err)
+			}
+			if ok != true || string(v) != expect {
+				tt.Errorf("%s actual: %s %v", key, v, ok)
+			}
+		}
+	})
+}
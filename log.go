@@ -3,7 +3,11 @@ package walmap
 import (
 	"bytes"
 	"io"
+	"math/rand/v2"
+	"os"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/octu0/walmap/codec"
 	"github.com/pkg/errors"
@@ -11,69 +15,273 @@ import (
 
 var (
 	ErrCompactRunning = errors.New("compat already in progress")
+	ErrClosed         = errors.New("log is closed")
 )
 
+// Recovery reports the torn tail dropped while recovering a log.
+type Recovery struct {
+	DroppedBytes   uint64
+	DroppedRecords uint64
+}
+
 type Log struct {
 	mutex       *sync.RWMutex
 	buf         *bytes.Buffer
+	file        *os.File
+	path        string
+	syncOnWrite bool
+	closed      bool   // set by Close, writes fail with ErrClosed from then on
+	written     uint64 // number of writes to the segment file
+	synced      uint64 // number of writes known to be on disk
 	indexes     map[string]codec.Index
+	expires     map[string]int64 // expiry (unix nano) of the keys written with a ttl
+	ordered     *skiplist        // keys in order, nil unless enabled by enableOrdered
 	compacting  bool
+	generation  uint64 // changes whenever buf is replaced, offsets of different generations are unrelated
+	notify      func(generation uint64, index codec.Index, record []byte)
 	currIndex   codec.Index
 	reclaimable uint64
 }
 
 func (l *Log) Write(key string, data []byte) error {
+	return l.WriteWithFlag(key, codec.FlagNone, data)
+}
+
+// WriteWithFlag is like Write but stores flag in the record header, e.g. codec.FlagRaw.
+func (l *Log) WriteWithFlag(key string, flag codec.Flag, data []byte) error {
+	return l.writeRecord(key, codec.Header{Flag: flag}, data)
+}
+
+// WriteWithExpire is like Write but key is treated as missing from expireAt.
+func (l *Log) WriteWithExpire(key string, data []byte, expireAt time.Time) error {
+	return l.writeRecord(key, codec.Header{ExpireAt: expireAt.UnixNano()}, data)
+}
+
+func (l *Log) writeRecord(key string, header codec.Header, data []byte) error {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
+	if l.closed {
+		return errors.WithStack(ErrClosed)
+	}
+
 	index := l.currIndex
-	nextIndex, err := codec.Encode(l.buf, index, key, data)
+	nextIndex, err := codec.EncodeRecord(l.buf, index, header, key, data)
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	if err := l.appendFile(index, nextIndex); err != nil {
+		return errors.WithStack(err)
+	}
 	if _, ok := l.indexes[key]; ok {
 		l.reclaimable += uint64(len(key)+len(data)) + codec.HeaderSize
 	}
 	l.indexes[key] = index
+	l.setExpire(key, header.ExpireAt)
+	l.setOrdered(key)
 	l.currIndex = nextIndex
+	l.notifyAppend(index, nextIndex)
 	return nil
 }
 
+func (l *Log) setOrdered(key string) {
+	if l.ordered != nil {
+		l.ordered.Insert(key)
+	}
+}
+
+// enableOrdered keeps the keys in order for scanKeys, starting from the keys already written.
+func (l *Log) enableOrdered() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.ordered != nil {
+		return
+	}
+	ordered := newSkiplist()
+	for key, _ := range l.indexes {
+		ordered.Insert(key)
+	}
+	l.ordered = ordered
+}
+
+// scanKeys returns up to limit live keys in order from from (inclusive) to end (exclusive, unbounded when empty),
+// more is false when there is none after them. without enableOrdered it sorts the matching keys and returns them all.
+func (l *Log) scanKeys(from, end string, limit int) ([]string, bool) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	now := time.Now().UnixNano()
+	inRange := func(key string) bool {
+		return end == "" || key < end
+	}
+	if l.ordered == nil {
+		keys := make([]string, 0)
+		for key, _ := range l.indexes {
+			if from <= key && inRange(key) && l.isExpired(key, now) != true {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		return keys, false
+	}
+
+	keys := make([]string, 0, limit)
+	more := false
+	l.ordered.Ascend(from, func(key string) bool {
+		if inRange(key) != true {
+			return false
+		}
+		if len(keys) == limit {
+			more = true
+			return false
+		}
+		if l.isExpired(key, now) != true {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys, more
+}
+
+func (l *Log) setExpire(key string, expireAt int64) {
+	if expireAt == 0 {
+		delete(l.expires, key)
+		return
+	}
+	l.expires[key] = expireAt
+}
+
+func (l *Log) isExpired(key string, now int64) bool {
+	expireAt, ok := l.expires[key]
+	if ok != true {
+		return false
+	}
+	return expireAt <= now
+}
+
 func (l *Log) Read(key string) ([]byte, bool, error) {
+	_, data, ok, err := l.readRecord(key)
+	if err != nil {
+		return nil, false, errors.WithStack(err)
+	}
+	return data, ok, nil
+}
+
+func (l *Log) readRecord(key string) (codec.Header, []byte, bool, error) {
+	var header codec.Header
+	var data []byte
+	ok, err := l.View(key, func(h codec.Header, d []byte) {
+		header = h
+		data = make([]byte, len(d))
+		copy(data, d)
+	})
+	if err != nil {
+		return codec.Header{}, nil, false, errors.WithStack(err)
+	}
+	return header, data, ok, nil
+}
+
+// View calls fn with the data of key without copying it.
+// data points into the log buffer and must not be retained nor modified after fn returns.
+func (l *Log) View(key string, fn func(header codec.Header, data []byte)) (bool, error) {
 	l.mutex.RLock()
 	defer l.mutex.RUnlock()
 
 	index, ok := l.indexes[key]
 	if ok != true {
-		return nil, false, nil
+		return false, nil
 	}
 
-	buf := l.buf.Bytes()
-	_, data, err := codec.Decode(bytes.NewReader(buf[index:]))
+	header, _, data, err := codec.DecodeView(l.buf.Bytes()[index:])
 	if err != nil {
-		return nil, false, errors.WithStack(err)
+		return false, errors.WithStack(err)
+	}
+	if header.IsExpired(time.Now().UnixNano()) {
+		return false, nil
 	}
-	return data, true, nil
+	fn(header, data)
+	return true, nil
 }
 
 func (l *Log) Delete(key string) ([]byte, bool, error) {
+	_, data, ok, err := l.deleteRecord(key)
+	if err != nil {
+		return nil, false, errors.WithStack(err)
+	}
+	return data, ok, nil
+}
+
+// deleteRecord removes key, an expired key is removed too but reported as missing.
+func (l *Log) deleteRecord(key string) (codec.Header, []byte, bool, error) {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
+	header, data, ok, err := l.deleteLocked(key)
+	if err != nil {
+		return codec.Header{}, nil, false, errors.WithStack(err)
+	}
+	if ok != true || header.IsExpired(time.Now().UnixNano()) {
+		return codec.Header{}, nil, false, nil
+	}
+	return header, data, true, nil
+}
+
+func (l *Log) deleteLocked(key string) (codec.Header, []byte, bool, error) {
+	if l.closed {
+		return codec.Header{}, nil, false, errors.WithStack(ErrClosed)
+	}
 	index, ok := l.indexes[key]
 	if ok != true {
-		return nil, false, nil
+		return codec.Header{}, nil, false, nil
 	}
 
 	buf := l.buf.Bytes()
-	_, data, err := codec.Decode(bytes.NewReader(buf[index:]))
+	header, _, data, err := codec.DecodeRecord(bytes.NewReader(buf[index:]))
 	if err != nil {
-		return nil, false, errors.WithStack(err)
+		return codec.Header{}, nil, false, errors.WithStack(err)
+	}
+
+	tombstoneIndex := l.currIndex
+	nextIndex, err := codec.EncodeTombstone(l.buf, tombstoneIndex, key)
+	if err != nil {
+		return codec.Header{}, nil, false, errors.WithStack(err)
+	}
+	if err := l.appendFile(tombstoneIndex, nextIndex); err != nil {
+		return codec.Header{}, nil, false, errors.WithStack(err)
 	}
 
 	delete(l.indexes, key)
+	delete(l.expires, key)
+	if l.ordered != nil {
+		l.ordered.Remove(key)
+	}
+	l.currIndex = nextIndex
+	l.notifyAppend(tombstoneIndex, nextIndex)
+	// both the deleted record and the tombstone itself are dropped by Compact
 	l.reclaimable += uint64(len(key)+len(data)) + codec.HeaderSize
-	return data, true, nil
+	l.reclaimable += uint64(len(key)) + codec.HeaderSize
+	return header, data, true, nil
+}
+
+// ReapExpired removes the keys expired at now and returns the number of removed keys.
+// the removed records are counted as reclaimable space.
+func (l *Log) ReapExpired(now time.Time) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	n := now.UnixNano()
+	count := 0
+	for key, expireAt := range l.expires {
+		if n < expireAt {
+			continue
+		}
+		if _, _, _, err := l.deleteLocked(key); err != nil {
+			return count, errors.WithStack(err)
+		}
+		count += 1
+	}
+	return count, nil
 }
 
 func (l *Log) ReclaimableSpace() uint64 {
@@ -87,131 +295,682 @@ func (l *Log) Len() int {
 	l.mutex.RLock()
 	defer l.mutex.RUnlock()
 
-	return len(l.indexes)
+	now := time.Now().UnixNano()
+	expired := 0
+	for key, _ := range l.expires {
+		if l.isExpired(key, now) {
+			expired += 1
+		}
+	}
+	return len(l.indexes) - expired
 }
 
 func (l *Log) Keys() []string {
 	l.mutex.RLock()
 	defer l.mutex.RUnlock()
 
+	now := time.Now().UnixNano()
 	keys := make([]string, 0, len(l.indexes))
 	for key, _ := range l.indexes {
+		if l.isExpired(key, now) {
+			continue
+		}
 		keys = append(keys, key)
 	}
 	return keys
 }
 
-func (l *Log) Size() uint64 {
+// rangeRecords calls fn with the encoded record (header, key and data) of every live key.
+func (l *Log) rangeRecords(fn func(key string, record []byte) error) error {
 	l.mutex.RLock()
 	defer l.mutex.RUnlock()
 
-	return uint64(l.buf.Len())
+	buf := l.buf.Bytes()
+	for key, index := range l.indexes {
+		size, err := recordSizeAt(buf, index)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err := fn(key, buf[uint64(index):uint64(index)+size]); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// appendRecord appends a record encoded by codec as is, records do not depend on their offset.
+func (l *Log) appendRecord(key string, record []byte) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.appendLocked(key, record)
+}
+
+func (l *Log) appendLocked(key string, record []byte) error {
+	if l.closed {
+		return errors.WithStack(ErrClosed)
+	}
+	header, err := codec.DecodeHeader(bytes.NewReader(record))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	index := l.currIndex
+	if _, err := l.buf.Write(record); err != nil {
+		return errors.WithStack(err)
+	}
+	nextIndex := index + codec.Index(len(record))
+	if err := l.appendFile(index, nextIndex); err != nil {
+		return errors.WithStack(err)
+	}
+	if _, ok := l.indexes[key]; ok {
+		l.reclaimable += uint64(len(record))
+	}
+	l.indexes[key] = index
+	l.setExpire(key, header.ExpireAt)
+	l.setOrdered(key)
+	l.currIndex = nextIndex
+	l.notifyAppend(index, nextIndex)
+	return nil
+}
+
+// applyRecords replays the encoded records of data in order, e.g. the records appended to another log since a position.
+func (l *Log) applyRecords(data []byte) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	offset := uint64(0)
+	for offset < uint64(len(data)) {
+		header, key, _, err := codec.DecodeView(data[offset:])
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		size := codec.HeaderSize + header.KeySize + header.DataSize
+		if header.IsTombstone() {
+			if _, _, _, err := l.deleteLocked(string(key)); err != nil {
+				return errors.WithStack(err)
+			}
+		} else {
+			if err := l.appendLocked(string(key), data[offset:offset+size]); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		offset += size
+	}
+	return nil
 }
 
-func (l *Log) compactRunning() bool {
+// replaceRecords makes the live records of data the content of the log, the keys missing from data are deleted.
+func (l *Log) replaceRecords(data []byte) error {
+	src, err := RestoreLog(bytes.NewReader(data), 0, 0)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for key, _ := range l.indexes {
+		if _, ok := src.indexes[key]; ok {
+			continue
+		}
+		if _, _, _, err := l.deleteLocked(key); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return src.rangeRecords(func(key string, record []byte) error {
+		return l.appendLocked(key, record)
+	})
+}
+
+func (l *Log) Size() uint64 {
 	l.mutex.RLock()
 	defer l.mutex.RUnlock()
 
-	return l.compacting
+	return uint64(l.buf.Len())
 }
 
-func (l *Log) copyLatest() (*bytes.Buffer, map[string]codec.Index, codec.Index, error) {
+// compactBatchSize is the number of records Compact copies per read lock.
+const compactBatchSize int = 1024
+
+func (l *Log) startCompact() (codec.Index, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.compacting {
+		return 0, false
+	}
+	l.compacting = true
+	return l.currIndex, true
+}
+
+func (l *Log) finishCompact() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.compacting = false
+}
+
+// copyLive copies the live records of buf[:endIndex] to newBuf, taking the read lock only per batch of records.
+// records below endIndex are never modified, they are only superseded by records appended after them.
+func (l *Log) copyLive(newBuf *bytes.Buffer, newIndexes map[string]codec.Index, endIndex codec.Index) error {
 	l.mutex.RLock()
-	defer l.mutex.RUnlock()
+	oldBuf := l.buf.Bytes()[:endIndex]
+	l.mutex.RUnlock()
+
+	offset := uint64(0)
+	for offset < uint64(endIndex) {
+		l.mutex.RLock()
+		for i := 0; i < compactBatchSize && offset < uint64(endIndex); i += 1 {
+			header, key, _, err := codec.DecodeView(oldBuf[offset:])
+			if err != nil {
+				l.mutex.RUnlock()
+				return errors.WithStack(err)
+			}
+			size := codec.HeaderSize + header.KeySize + header.DataSize
+			if index, ok := l.indexes[string(key)]; ok && uint64(index) == offset {
+				newIndexes[string(key)] = codec.Index(newBuf.Len())
+				newBuf.Write(oldBuf[offset : offset+size])
+			}
+			offset += size
+		}
+		l.mutex.RUnlock()
+	}
+	return nil
+}
 
-	oldBuf := l.buf.Bytes()
-	newBuf := bytes.NewBuffer(make([]byte, 0, len(oldBuf)))
-	newIndexes := make(map[string]codec.Index, len(l.indexes))
-	newCurrIndex := codec.Index(0)
-	for key, oldIndex := range l.indexes {
-		_, data, err := codec.Decode(bytes.NewReader(oldBuf[oldIndex:]))
+// replayTail appends the records written from startIndex while copyLive was running, must be called with the write lock held.
+func (l *Log) replayTail(newBuf *bytes.Buffer, newIndexes map[string]codec.Index, startIndex codec.Index) (uint64, error) {
+	tail := l.buf.Bytes()[startIndex:]
+	reclaimable := uint64(0)
+	offset := uint64(0)
+	for offset < uint64(len(tail)) {
+		header, key, _, err := codec.DecodeView(tail[offset:])
 		if err != nil {
-			return nil, nil, 0, errors.WithStack(err)
+			return 0, errors.WithStack(err)
 		}
-		next, err := codec.Encode(newBuf, newCurrIndex, key, data)
-		if err != nil {
-			return nil, nil, 0, errors.WithStack(err)
+		size := codec.HeaderSize + header.KeySize + header.DataSize
+		newIndex := codec.Index(newBuf.Len())
+		newBuf.Write(tail[offset : offset+size])
+
+		if oldIndex, ok := newIndexes[string(key)]; ok {
+			oldSize, err := recordSizeAt(newBuf.Bytes(), oldIndex)
+			if err != nil {
+				return 0, errors.WithStack(err)
+			}
+			reclaimable += oldSize
+		}
+		if header.IsTombstone() {
+			delete(newIndexes, string(key))
+			reclaimable += size
+		} else {
+			newIndexes[string(key)] = newIndex
 		}
-		newIndexes[key] = newCurrIndex
-		newCurrIndex = next
+		offset += size
 	}
-	return newBuf, newIndexes, newCurrIndex, nil
+	return reclaimable, nil
 }
 
+// Compact drops the overwritten and deleted records.
+// live records are copied without blocking writers for the whole pass,
+// the writes made meanwhile are replayed onto the copy before it replaces the log.
 func (l *Log) Compact() error {
-	if l.compactRunning() {
+	startIndex, ok := l.startCompact()
+	if ok != true {
 		return ErrCompactRunning
 	}
+	defer l.finishCompact()
 
-	l.mutex.Lock()
-	l.compacting = true
-	l.mutex.Unlock()
-	defer func() {
-		l.mutex.Lock()
-		l.compacting = false
-		l.mutex.Unlock()
-	}()
+	l.mutex.RLock()
+	newBuf := bytes.NewBuffer(make([]byte, 0, int(startIndex)))
+	newIndexes := make(map[string]codec.Index, len(l.indexes))
+	path := l.path
+	hasFile := l.file != nil
+	l.mutex.RUnlock()
 
-	newBuf, newIndexes, newCurrIndex, err := l.copyLatest()
-	if err != nil {
-		return err
+	if err := l.copyLive(newBuf, newIndexes, startIndex); err != nil {
+		return errors.WithStack(err)
 	}
 
+	var tmp *os.File
+	if hasFile {
+		f, err := createCompactFile(path, newBuf.Bytes())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		tmp = f
+	}
+	copied := newBuf.Len()
+
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
+	reclaimable, err := l.replayTail(newBuf, newIndexes, startIndex)
+	if err != nil {
+		discardCompactFile(tmp)
+		return errors.WithStack(err)
+	}
+	if tmp != nil {
+		if l.file == nil {
+			// closed while compacting, the segment file is left as is
+			discardCompactFile(tmp)
+			return nil
+		}
+		if err := l.replaceFile(tmp, newBuf.Bytes()[copied:]); err != nil {
+			return errors.WithStack(err)
+		}
+	}
 	l.buf = newBuf
 	l.indexes = newIndexes
-	l.currIndex = newCurrIndex
-	l.reclaimable = 0
+	l.generation = rand.Uint64()
+	l.currIndex = codec.Index(newBuf.Len())
+	l.reclaimable = reclaimable
 	return nil
 }
 
-func (l *Log) Snapshot(w io.Writer) error {
+// setNotify makes the log call fn with every record it appends, under its write lock.
+func (l *Log) setNotify(fn func(generation uint64, index codec.Index, record []byte)) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.notify = fn
+}
+
+func (l *Log) notifyAppend(index, nextIndex codec.Index) {
+	if l.notify == nil {
+		return
+	}
+	// records below currIndex are never modified, the slice stays valid
+	l.notify(l.generation, index, l.buf.Bytes()[index:nextIndex])
+}
+
+// position returns the generation of the log and the records written so far, see bytes.
+func (l *Log) position() (uint64, []byte) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return l.generation, l.buf.Bytes()
+}
+
+// bytes returns the records written so far.
+// the returned slice stays valid and unchanged after the lock is released: records are only appended after it,
+// and Compact replaces the buffer instead of modifying it.
+func (l *Log) bytes() []byte {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return l.buf.Bytes()
+}
+
+// logEntry is the position of a live record in the buffer returned by entries.
+type logEntry struct {
+	key   string
+	index codec.Index
+}
+
+// entries returns the live records and the buffer they point into, which stays valid as described in bytes.
+func (l *Log) entries() ([]logEntry, []byte) {
 	l.mutex.RLock()
 	defer l.mutex.RUnlock()
 
-	if _, err := w.Write(l.buf.Bytes()); err != nil {
+	now := time.Now().UnixNano()
+	entries := make([]logEntry, 0, len(l.indexes))
+	for key, index := range l.indexes {
+		if l.isExpired(key, now) {
+			continue
+		}
+		entries = append(entries, logEntry{key, index})
+	}
+	return entries, l.buf.Bytes()
+}
+
+func (l *Log) Snapshot(w io.Writer) error {
+	if _, err := w.Write(l.bytes()); err != nil {
 		return err
 	}
 	return nil
 }
 
+// appendFile writes the record encoded in buf[index:nextIndex] to the segment file.
+// on failure the record is dropped from buf and the file so memory never gets ahead of disk.
+func (l *Log) appendFile(index, nextIndex codec.Index) error {
+	if l.file == nil {
+		return nil
+	}
+	if _, err := l.file.Write(l.buf.Bytes()[index:nextIndex]); err != nil {
+		return l.dropTail(index, err)
+	}
+	if l.syncOnWrite {
+		if err := syncFile(l.file); err != nil {
+			return l.dropTail(index, err)
+		}
+		l.written += 1
+		l.synced = l.written
+		return nil
+	}
+	l.written += 1
+	return nil
+}
+
+func (l *Log) dirty() bool {
+	return l.synced < l.written
+}
+
+// dropTail truncates buf and the segment file back to index after the record written there failed with err.
+func (l *Log) dropTail(index codec.Index, err error) error {
+	l.buf.Truncate(int(index))
+	if terr := l.file.Truncate(int64(index)); terr != nil {
+		return errors.Wrapf(err, "truncate segment file: %v", terr)
+	}
+	return errors.WithStack(err)
+}
+
+// syncFile flushes f to disk, replaced by tests to hold a sync in flight.
+var syncFile = (*os.File).Sync
+
+// Sync flushes the segment file to disk if it has writes that are not synced yet.
+// it returns once every write made before the call is on disk, whether by this call or a concurrent one.
+func (l *Log) Sync() error {
+	l.mutex.RLock()
+	f := l.file
+	written := l.written
+	synced := l.synced
+	l.mutex.RUnlock()
+
+	if f == nil || written <= synced {
+		return nil
+	}
+	if err := syncFile(f); err != nil {
+		if errors.Is(err, os.ErrClosed) && l.syncedUpTo(written) {
+			// replaced by Compact or closed by Close, which synced the file before closing it
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == f && l.synced < written {
+		l.synced = written
+	}
+	return nil
+}
+
+func (l *Log) syncedUpTo(written uint64) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return written <= l.synced
+}
+
+// createCompactFile writes data to the temporary file that replaceFile renames over the segment file.
+// it is synced here, without the log lock, so that replaceFile only has the tail left to sync under it.
+func createCompactFile(path string, data []byte) (*os.File, error) {
+	tmp, err := os.OpenFile(path+".compact", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		discardCompactFile(tmp)
+		return nil, errors.WithStack(err)
+	}
+	if err := syncFile(tmp); err != nil {
+		discardCompactFile(tmp)
+		return nil, errors.WithStack(err)
+	}
+	return tmp, nil
+}
+
+func discardCompactFile(tmp *os.File) {
+	if tmp == nil {
+		return
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+}
+
+// replaceFile appends tail to tmp and replaces the segment file with it atomically (sync and rename).
+// the part written by createCompactFile is already synced, only tail is flushed under the lock.
+func (l *Log) replaceFile(tmp *os.File, tail []byte) error {
+	if _, err := tmp.Write(tail); err != nil {
+		discardCompactFile(tmp)
+		return errors.WithStack(err)
+	}
+	if err := syncFile(tmp); err != nil {
+		discardCompactFile(tmp)
+		return errors.WithStack(err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.WithStack(err)
+	}
+	if err := os.Rename(tmp.Name(), l.path); err != nil {
+		os.Remove(tmp.Name())
+		return errors.WithStack(err)
+	}
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	l.file.Close()
+	l.file = f
+	l.synced = l.written
+	return nil
+}
+
+// Close flushes and closes the segment file, writes fail with ErrClosed afterwards.
+func (l *Log) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.closed = true
+	if l.file == nil {
+		return nil
+	}
+	if l.dirty() {
+		if err := syncFile(l.file); err != nil {
+			return errors.WithStack(err)
+		}
+		l.synced = l.written
+	}
+	if err := l.file.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	l.file = nil
+	return nil
+}
+
+func recordSizeAt(buf []byte, index codec.Index) (uint64, error) {
+	header, err := codec.DecodeHeader(bytes.NewReader(buf[index:]))
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return header.KeySize + header.DataSize + codec.HeaderSize, nil
+}
+
 func RestoreLog(r io.Reader, initialLogSize, initialIndexSize int) (*Log, error) {
 	currIndex := codec.Index(0)
 	newBuf := bytes.NewBuffer(make([]byte, 0, initialLogSize))
 	newIndexes := make(map[string]codec.Index, initialIndexSize)
+	newExpires := make(map[string]int64)
+	reclaimable := uint64(0)
 	for {
-		key, data, err := codec.Decode(r)
+		header, key, data, err := codec.DecodeRecord(r)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				break
 			}
 			return nil, errors.WithStack(err)
 		}
-		next, err := codec.Encode(newBuf, currIndex, key, data)
+		if header.IsTombstone() {
+			next, err := codec.EncodeTombstone(newBuf, currIndex, key)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if oldIndex, ok := newIndexes[key]; ok {
+				oldSize, err := recordSizeAt(newBuf.Bytes(), oldIndex)
+				if err != nil {
+					return nil, errors.WithStack(err)
+				}
+				reclaimable += oldSize
+				delete(newIndexes, key)
+				delete(newExpires, key)
+			}
+			reclaimable += uint64(len(key)) + codec.HeaderSize
+			currIndex = next
+			continue
+		}
+
+		next, err := codec.EncodeRecord(newBuf, currIndex, header, key, data)
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
+		if oldIndex, ok := newIndexes[key]; ok {
+			oldSize, err := recordSizeAt(newBuf.Bytes(), oldIndex)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			reclaimable += oldSize
+		}
 		newIndexes[key] = currIndex
+		if header.ExpireAt != 0 {
+			newExpires[key] = header.ExpireAt
+		} else {
+			delete(newExpires, key)
+		}
 		currIndex = next
 	}
 	return &Log{
 		mutex:       new(sync.RWMutex),
 		buf:         newBuf,
 		compacting:  false,
+		generation:  rand.Uint64(),
 		indexes:     newIndexes,
+		expires:     newExpires,
 		currIndex:   currIndex,
-		reclaimable: uint64(0),
+		reclaimable: reclaimable,
 	}, nil
 }
 
+// validSize returns the size of the leading run of intact records in data.
+func validSize(data []byte) uint64 {
+	offset := uint64(0)
+	for offset < uint64(len(data)) {
+		size, err := codec.Verify(data[offset:])
+		if err != nil {
+			break
+		}
+		offset += size
+	}
+	return offset
+}
+
+// countRecords counts the records framed in a torn tail, the last partial one included.
+func countRecords(tail []byte) uint64 {
+	count := uint64(0)
+	for 0 < len(tail) {
+		count += 1
+		if uint64(len(tail)) < codec.HeaderSize {
+			break
+		}
+		header, err := codec.DecodeHeader(bytes.NewReader(tail))
+		if err != nil {
+			break
+		}
+		size := codec.HeaderSize + header.KeySize + header.DataSize
+		if uint64(len(tail)) < size {
+			break
+		}
+		tail = tail[size:]
+	}
+	return count
+}
+
+// RecoverLog is like RestoreLog but instead of failing on a torn or corrupt record,
+// it keeps the records before it and drops everything after.
+func RecoverLog(r io.Reader, initialLogSize, initialIndexSize int) (*Log, Recovery, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, Recovery{}, errors.WithStack(err)
+	}
+	return recoverLog(data, initialLogSize, initialIndexSize)
+}
+
+func recoverLog(data []byte, initialLogSize, initialIndexSize int) (*Log, Recovery, error) {
+	valid := validSize(data)
+	log, err := RestoreLog(bytes.NewReader(data[:valid]), initialLogSize, initialIndexSize)
+	if err != nil {
+		return nil, Recovery{}, errors.WithStack(err)
+	}
+	return log, Recovery{
+		DroppedBytes:   uint64(len(data)) - valid,
+		DroppedRecords: countRecords(data[valid:]),
+	}, nil
+}
+
+// OpenLog opens the segment file at path (creating it if missing),
+// rebuilds indexes from its records and appends subsequent writes to it.
+func OpenLog(path string, initialLogSize, initialIndexSize int) (*Log, error) {
+	log, _, err := openLog(path, initialLogSize, initialIndexSize, false)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return log, nil
+}
+
+// openLog opens the segment file at path, with recover the torn tail is truncated from the file.
+func openLog(path string, initialLogSize, initialIndexSize int, recover bool) (*Log, Recovery, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, Recovery{}, errors.WithStack(err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, Recovery{}, errors.WithStack(err)
+	}
+
+	if recover != true {
+		log, err := RestoreLog(bytes.NewReader(data), initialLogSize, initialIndexSize)
+		if err != nil {
+			f.Close()
+			return nil, Recovery{}, errors.WithStack(err)
+		}
+		log.file = f
+		log.path = path
+		return log, Recovery{}, nil
+	}
+
+	log, recovery, err := recoverLog(data, initialLogSize, initialIndexSize)
+	if err != nil {
+		f.Close()
+		return nil, Recovery{}, errors.WithStack(err)
+	}
+	if 0 < recovery.DroppedBytes {
+		if err := f.Truncate(int64(log.Size())); err != nil {
+			f.Close()
+			return nil, Recovery{}, errors.WithStack(err)
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return nil, Recovery{}, errors.WithStack(err)
+		}
+	}
+	log.file = f
+	log.path = path
+	return log, recovery, nil
+}
+
 func NewLog(logSize, indexSize int) *Log {
 	return &Log{
 		mutex:       new(sync.RWMutex),
 		buf:         bytes.NewBuffer(make([]byte, 0, logSize)),
 		compacting:  false,
+		generation:  rand.Uint64(),
 		indexes:     make(map[string]codec.Index, indexSize),
+		expires:     make(map[string]int64),
 		currIndex:   codec.Index(0),
 		reclaimable: uint64(0),
 	}
@@ -2,7 +2,14 @@ package walmap
 
 import (
 	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
+
+	"github.com/octu0/walmap/codec"
+	"github.com/pkg/errors"
 )
 
 func TestLogReadWrite(t *testing.T) {
@@ -139,7 +146,9 @@ func TestLogCompact(t *testing.T) {
 		t.Errorf("no error: %+v", err)
 	}
 
-	if s := log.ReclaimableSpace(); s != 26 { // 26 = 8(keysize) + 8(datasize) + 4(len("keyA")) + 6(len("valueA"))
+	// 72 = deleted record 39 = 8(keysize) + 8(datasize) + 1(flag) + 8(expireat) + 4(checksum) + 4(len("keyA")) + 6(len("valueA"))
+	//    + tombstone     33 = 8(keysize) + 8(datasize) + 1(flag) + 8(expireat) + 4(checksum) + 4(len("keyA"))
+	if s := log.ReclaimableSpace(); s != 72 {
 		t.Errorf("actual: %d", s)
 	}
 
@@ -193,3 +202,421 @@ func TestLogCompact(t *testing.T) {
 		t.Errorf("actual: %v", data2)
 	}
 }
+
+func TestLogCompactConcurrentWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+	log, err := OpenLog(path, 10, 10)
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	for i := 0; i < 10000; i += 1 {
+		if err := log.Write("key"+strconv.Itoa(i), []byte("old"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("no error: %+v", err)
+		}
+	}
+
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// overwrite odd keys and delete even keys while compacting
+		for i := 0; i < 10000; i += 1 {
+			key := "key" + strconv.Itoa(i)
+			if i%2 == 0 {
+				if _, _, err := log.Delete(key); err != nil {
+					t.Errorf("no error: %+v", err)
+				}
+				continue
+			}
+			if err := log.Write(key, []byte("new"+strconv.Itoa(i))); err != nil {
+				t.Errorf("no error: %+v", err)
+			}
+		}
+	}()
+	for i := 0; i < 5; i += 1 {
+		if err := log.Compact(); err != nil {
+			t.Errorf("no error: %+v", err)
+		}
+	}
+	wg.Wait()
+
+	verify := func(tt *testing.T, l *Log) {
+		if l.Len() != 5000 {
+			tt.Errorf("actual: %d", l.Len())
+		}
+		for i := 0; i < 10000; i += 1 {
+			data, ok, err := l.Read("key" + strconv.Itoa(i))
+			if err != nil {
+				tt.Errorf("no error: %+v", err)
+			}
+			if i%2 == 0 {
+				if ok {
+					tt.Errorf("key%d must be deleted", i)
+				}
+				continue
+			}
+			if ok != true || string(data) != "new"+strconv.Itoa(i) {
+				tt.Errorf("key%d actual: %s", i, data)
+			}
+		}
+	}
+	t.Run("memory", func(tt *testing.T) {
+		verify(tt, log)
+	})
+	t.Run("compact", func(tt *testing.T) {
+		if err := log.Compact(); err != nil {
+			tt.Errorf("no error: %+v", err)
+		}
+		if log.ReclaimableSpace() != 0 {
+			tt.Errorf("actual: %d", log.ReclaimableSpace())
+		}
+		verify(tt, log)
+	})
+	t.Run("reopen", func(tt *testing.T) {
+		if err := log.Close(); err != nil {
+			tt.Errorf("no error: %+v", err)
+		}
+		reopened, err := OpenLog(path, 10, 10)
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		defer reopened.Close()
+
+		verify(tt, reopened)
+	})
+}
+
+func TestLogOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+
+	log1, err := OpenLog(path, 10, 10)
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	if err := log1.Write("hello", []byte("world")); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if err := log1.Write("keyA", []byte("valueA")); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if err := log1.Write("hello", []byte("world2")); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if err := log1.Close(); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+
+	log2, err := OpenLog(path, 10, 10)
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	data1, ok1, err := log2.Read("hello")
+	if err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if ok1 != true {
+		t.Errorf("exists key!")
+	}
+	if bytes.Equal(data1, []byte("world2")) != true {
+		t.Errorf("actual: %s", data1)
+	}
+
+	if err := log2.Compact(); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if err := log2.Write("test", []byte("test")); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	size := log2.Size()
+	if err := log2.Close(); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	if uint64(stat.Size()) != size {
+		t.Errorf("compacted file size = %d, log size = %d", stat.Size(), size)
+	}
+
+	log3, err := OpenLog(path, 10, 10)
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	defer log3.Close()
+
+	if log3.Len() != 3 {
+		t.Errorf("actual: %d", log3.Len())
+	}
+	data2, ok2, err := log3.Read("keyA")
+	if err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if ok2 != true {
+		t.Errorf("exists key!")
+	}
+	if bytes.Equal(data2, []byte("valueA")) != true {
+		t.Errorf("actual: %s", data2)
+	}
+	data3, ok3, err := log3.Read("test")
+	if err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if ok3 != true {
+		t.Errorf("exists key!")
+	}
+	if bytes.Equal(data3, []byte("test")) != true {
+		t.Errorf("actual: %s", data3)
+	}
+}
+
+func TestLogDeleteRestore(t *testing.T) {
+	log1 := NewLog(10, 10)
+	if err := log1.Write("hello", []byte("world")); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if err := log1.Write("keyA", []byte("valueA")); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if _, _, err := log1.Delete("keyA"); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if err := log1.Write("test", []byte("test")); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if _, _, err := log1.Delete("test"); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if err := log1.Write("test", []byte("test2")); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := log1.Snapshot(out); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+
+	log2, err := RestoreLog(bytes.NewReader(out.Bytes()), 10, 10)
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	if log2.Len() != 2 {
+		t.Errorf("actual: %d", log2.Len())
+	}
+	if _, ok, err := log2.Read("keyA"); err != nil {
+		t.Errorf("no error: %+v", err)
+	} else if ok {
+		t.Errorf("deleted key restored")
+	}
+	data, ok, err := log2.Read("test")
+	if err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if ok != true {
+		t.Errorf("exists key!")
+	}
+	if bytes.Equal(data, []byte("test2")) != true {
+		t.Errorf("actual: %s", data)
+	}
+	if log1.ReclaimableSpace() != log2.ReclaimableSpace() {
+		t.Errorf("reclaimable org = %d restored = %d", log1.ReclaimableSpace(), log2.ReclaimableSpace())
+	}
+}
+
+func TestRecoverLog(t *testing.T) {
+	log1 := NewLog(10, 10)
+	if err := log1.Write("hello", []byte("world")); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if err := log1.Write("keyA", []byte("valueA")); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	validSize := log1.Size()
+	if err := log1.Write("torn", []byte("record")); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := log1.Snapshot(out); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	data := out.Bytes()[:out.Len()-3]
+
+	if _, err := RestoreLog(bytes.NewReader(data), 10, 10); err == nil {
+		t.Errorf("torn tail must be error")
+	}
+
+	log2, recovery, err := RecoverLog(bytes.NewReader(data), 10, 10)
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	if recovery.DroppedRecords != 1 {
+		t.Errorf("actual: %d", recovery.DroppedRecords)
+	}
+	if recovery.DroppedBytes != uint64(len(data))-validSize {
+		t.Errorf("actual: %d", recovery.DroppedBytes)
+	}
+	if log2.Size() != validSize {
+		t.Errorf("actual: %d", log2.Size())
+	}
+	if log2.Len() != 2 {
+		t.Errorf("actual: %d", log2.Len())
+	}
+	if _, ok, _ := log2.Read("torn"); ok {
+		t.Errorf("torn record dropped")
+	}
+
+	log3, recovery, err := RecoverLog(bytes.NewReader(out.Bytes()), 10, 10)
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	if recovery.DroppedBytes != 0 {
+		t.Errorf("actual: %d", recovery.DroppedBytes)
+	}
+	if log3.Len() != 3 {
+		t.Errorf("actual: %d", log3.Len())
+	}
+}
+
+func TestLogOpenRecover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+
+	log1, err := OpenLog(path, 10, 10)
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	if err := log1.Write("hello", []byte("world")); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	validSize := log1.Size()
+	if err := log1.Close(); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	if _, err := f.Write([]byte{0x00, 0x00, 0x00, 0x01}); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	f.Close()
+
+	log2, recovery, err := openLog(path, 10, 10, true)
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	if recovery.DroppedBytes != 4 {
+		t.Errorf("actual: %d", recovery.DroppedBytes)
+	}
+	if recovery.DroppedRecords != 1 {
+		t.Errorf("actual: %d", recovery.DroppedRecords)
+	}
+	if err := log2.Write("keyA", []byte("valueA")); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if err := log2.Close(); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+
+	log3, err := OpenLog(path, 10, 10)
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	defer log3.Close()
+
+	if log3.Len() != 2 {
+		t.Errorf("actual: %d", log3.Len())
+	}
+	if log3.Size() <= validSize {
+		t.Errorf("actual: %d", log3.Size())
+	}
+}
+
+func TestLogDropTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+
+	log1, err := OpenLog(path, 10, 10)
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	if err := log1.Write("hello", []byte("world")); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+
+	// a record torn by a failed write, in memory and on disk
+	index := log1.currIndex
+	torn := bytes.NewBuffer(nil)
+	if _, err := codec.Encode(torn, index, "torn", []byte("record")); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	log1.buf.Write(torn.Bytes()[:10])
+	if _, err := log1.file.Write(torn.Bytes()[:10]); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	if err := log1.dropTail(index, os.ErrInvalid); errors.Is(err, os.ErrInvalid) != true {
+		t.Errorf("write error: %+v", err)
+	}
+
+	if err := log1.Write("keyA", []byte("valueA")); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if err := log1.Close(); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+
+	log2, err := OpenLog(path, 10, 10)
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	defer log2.Close()
+
+	if log2.Len() != 2 {
+		t.Errorf("actual: %d", log2.Len())
+	}
+	if data, ok, err := log2.Read("keyA"); err != nil || ok != true || string(data) != "valueA" {
+		t.Errorf("actual: %s %v %+v", data, ok, err)
+	}
+}
+
+func TestLogCompactSyncOutsideLock(t *testing.T) {
+	log, err := OpenLog(filepath.Join(t.TempDir(), "test.wal"), 10, 10)
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	defer log.Close()
+
+	for i := 0; i < 100; i += 1 {
+		if err := log.Write("key"+strconv.Itoa(i%10), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("no error: %+v", err)
+		}
+	}
+
+	// whether the log was locked at each sync of the compacted file
+	locked := make([]bool, 0)
+	orig := syncFile
+	syncFile = func(f *os.File) error {
+		if filepath.Ext(f.Name()) == ".compact" {
+			if log.mutex.TryLock() {
+				log.mutex.Unlock()
+				locked = append(locked, false)
+			} else {
+				locked = append(locked, true)
+			}
+		}
+		return orig(f)
+	}
+	defer func() { syncFile = orig }()
+
+	if err := log.Compact(); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	// the copied records outside the lock, then the replayed tail under it
+	if len(locked) != 2 || locked[0] || locked[1] != true {
+		t.Errorf("actual: %v", locked)
+	}
+	if log.Len() != 10 {
+		t.Errorf("actual: %d", log.Len())
+	}
+}
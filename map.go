@@ -0,0 +1,598 @@
+package walmap
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/octu0/walmap/codec"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrReshardDurable = errors.New("reshard is not supported on maps opened by Open")
+	ErrNotDurable     = errors.New("map has no segment files, open it with Open")
+)
+
+// Map is a concurrent map of V whose values are stored in the WAL encoded by a ValueCodec.
+type Map[V any] struct {
+	s            atomic.Pointer[shards]
+	opt          *walmapOpt
+	codec        ValueCodec[V]
+	reshardMutex *sync.Mutex
+	done         chan struct{}
+	wg           *sync.WaitGroup
+	closeOnce    *sync.Once
+	subs         *subscribers
+	applied      SnapshotToken // token of the last delta applied by ApplyDelta, guarded by reshardMutex
+}
+
+// lockShard returns the write-locked shard of key, looking it up again if Reshard replaced it meanwhile.
+func (c *Map[V]) lockShard(key string) *walCache {
+	for {
+		m := c.s.Load().GetShard(key)
+		m.Lock()
+		if m.retired != true {
+			return m
+		}
+		m.Unlock()
+	}
+}
+
+// rlockShard is the read-locked version of lockShard.
+func (c *Map[V]) rlockShard(key string) *walCache {
+	for {
+		m := c.s.Load().GetShard(key)
+		m.RLock()
+		if m.retired != true {
+			return m
+		}
+		m.RUnlock()
+	}
+}
+
+func (c *Map[V]) Set(key string, value V) {
+	if err := c.SetE(key, value); err != nil {
+		c.opt.errorHandler("Set", key, err)
+	}
+}
+
+// SetE is like Set but returns the error that prevented value from being stored.
+func (c *Map[V]) SetE(key string, value V) error {
+	m := c.lockShard(key)
+	defer m.Unlock()
+
+	if err := setValueE(m, c.codec, key, value); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// SetWithTTL is like Set but key is treated as missing once ttl has elapsed.
+// expired keys are removed by the reaper of WithExpiryReaper or when they are overwritten or removed.
+func (c *Map[V]) SetWithTTL(key string, value V, ttl time.Duration) {
+	if err := c.SetWithTTLE(key, value, ttl); err != nil {
+		c.opt.errorHandler("SetWithTTL", key, err)
+	}
+}
+
+// SetWithTTLE is like SetWithTTL but returns the error.
+func (c *Map[V]) SetWithTTLE(key string, value V, ttl time.Duration) error {
+	m := c.lockShard(key)
+	defer m.Unlock()
+
+	if err := setValueWithExpireE(m, c.codec, key, value, time.Now().Add(ttl)); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// SetSync is like Set but returns once value is durable on disk, or the error that prevented it.
+// it fails with ErrNotDurable without writing on a map that has no segment files (New, Restore).
+func (c *Map[V]) SetSync(key string, value V) error {
+	m := c.lockShard(key)
+	defer m.Unlock()
+
+	if m.log.path == "" {
+		return errors.Wrapf(ErrNotDurable, "SetSync(%s)", key)
+	}
+	if err := setValueE(m, c.codec, key, value); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := m.Sync(); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (c *Map[V]) Get(key string) (V, bool) {
+	value, ok, err := c.GetE(key)
+	if err != nil {
+		c.opt.errorHandler("Get", key, err)
+		return value, false
+	}
+	return value, ok
+}
+
+// GetE is like Get but tells a missing key apart from a record that cannot be read or decoded (e.g. codec.ErrCorruptRecord).
+func (c *Map[V]) GetE(key string) (V, bool, error) {
+	m := c.rlockShard(key)
+	defer m.RUnlock()
+
+	value, ok, err := getValueE(m, c.codec, key)
+	if err != nil {
+		return value, false, errors.WithStack(err)
+	}
+	return value, ok, nil
+}
+
+// SetBytes stores data for key as is, skipping the ValueCodec.
+// Get returns it as []byte when V can hold it (e.g. WALMap), otherwise decodes it with the ValueCodec.
+func (c *Map[V]) SetBytes(key string, data []byte) {
+	m := c.lockShard(key)
+	defer m.Unlock()
+
+	if err := setBytes(m, key, data); err != nil {
+		c.opt.errorHandler("SetBytes", key, err)
+	}
+}
+
+// GetBytes returns a copy of the bytes stored for key: the data of SetBytes, or the encoded value of Set.
+func (c *Map[V]) GetBytes(key string) ([]byte, bool) {
+	m := c.rlockShard(key)
+	defer m.RUnlock()
+
+	data, ok, err := m.log.Read(key)
+	if err != nil {
+		c.opt.errorHandler("GetBytes", key, err)
+		return nil, false
+	}
+	return data, ok
+}
+
+// ViewBytes calls fn with the bytes stored for key without copying, while holding the read lock of its shard.
+// data must not be retained nor modified after fn returns, and fn must not write to the map.
+func (c *Map[V]) ViewBytes(key string, fn func(data []byte)) bool {
+	m := c.rlockShard(key)
+	defer m.RUnlock()
+
+	ok, err := m.log.View(key, func(_ codec.Header, data []byte) {
+		fn(data)
+	})
+	if err != nil {
+		c.opt.errorHandler("ViewBytes", key, err)
+		return false
+	}
+	return ok
+}
+
+func (c *Map[V]) Remove(key string) (V, bool) {
+	value, ok, err := c.RemoveE(key)
+	if err != nil {
+		c.opt.errorHandler("Remove", key, err)
+		return value, false
+	}
+	return value, ok
+}
+
+// RemoveE is like Remove but returns the error that prevented key from being removed or its value from being decoded.
+func (c *Map[V]) RemoveE(key string) (V, bool, error) {
+	m := c.lockShard(key)
+	defer m.Unlock()
+
+	value, ok, err := removeValueE(m, c.codec, key)
+	if err != nil {
+		return value, false, errors.WithStack(err)
+	}
+	return value, ok, nil
+}
+
+// RemoveSync is like Remove but returns once the removal is durable on disk, or the error that prevented it.
+// it fails with ErrNotDurable without removing on a map that has no segment files (New, Restore).
+func (c *Map[V]) RemoveSync(key string) (V, bool, error) {
+	m := c.lockShard(key)
+	defer m.Unlock()
+
+	var empty V
+	if m.log.path == "" {
+		return empty, false, errors.Wrapf(ErrNotDurable, "RemoveSync(%s)", key)
+	}
+	value, ok, err := removeValueE(m, c.codec, key)
+	if err != nil {
+		return empty, false, errors.WithStack(err)
+	}
+	if ok != true {
+		return empty, false, nil
+	}
+	if err := m.Sync(); err != nil {
+		return empty, false, errors.WithStack(err)
+	}
+	return value, true, nil
+}
+
+func (c *Map[V]) Len() int {
+	count := 0
+	for _, m := range c.s.Load().Shards() {
+		m.RLock()
+		count += m.Len()
+		m.RUnlock()
+	}
+	return count
+}
+
+func (c *Map[V]) Keys() []string {
+	shards := c.s.Load().Shards()
+	keys := make([]string, 0, len(shards))
+	for _, m := range shards {
+		m.RLock()
+		keys = append(keys, m.Keys()...)
+		m.RUnlock()
+	}
+	return keys
+}
+
+func (c *Map[V]) Upsert(key string, fn func(exists bool, oldValue V) V) (newValue V) {
+	m := c.lockShard(key)
+	defer m.Unlock()
+
+	oldValue, ok, err := getValueE(m, c.codec, key)
+	if err != nil {
+		c.opt.errorHandler("Upsert", key, err)
+	}
+	newValue = fn(ok, oldValue)
+	if err := setValueE(m, c.codec, key, newValue); err != nil {
+		c.opt.errorHandler("Upsert", key, err)
+	}
+	return
+}
+
+func (c *Map[V]) SetIfAbsent(key string, value V) (updated bool) {
+	m := c.lockShard(key)
+	defer m.Unlock()
+
+	_, ok, err := getValueE(m, c.codec, key)
+	if err != nil {
+		c.opt.errorHandler("SetIfAbsent", key, err)
+	}
+	if ok != true {
+		if err := setValueE(m, c.codec, key, value); err != nil {
+			c.opt.errorHandler("SetIfAbsent", key, err)
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+func (c *Map[V]) RemoveIf(key string, fn func(exists bool, value V) bool) (removed bool) {
+	m := c.lockShard(key)
+	defer m.Unlock()
+
+	v, ok, err := getValueE(m, c.codec, key)
+	if err != nil {
+		c.opt.errorHandler("RemoveIf", key, err)
+	}
+	remove := fn(ok, v)
+	if remove && ok {
+		if _, _, err := removeValueE(m, c.codec, key); err != nil {
+			c.opt.errorHandler("RemoveIf", key, err)
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+func (c *Map[V]) Snapshot(w io.Writer) error {
+	if c.opt.consistent {
+		return c.SnapshotConsistent(w)
+	}
+	if err := c.s.Load().Snapshot(w, c.opt); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// SnapshotConsistent writes a snapshot of every shard as of the same instant,
+// whereas Snapshot captures the shards one after another while writes continue.
+func (c *Map[V]) SnapshotConsistent(w io.Writer) error {
+	if err := c.s.Load().SnapshotConsistent(w, c.opt); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// SnapshotSince writes the changes since the snapshot of token (see ApplyDelta) and returns the token of this snapshot.
+// shards compacted since token are written in full, a zero token writes every shard in full.
+func (c *Map[V]) SnapshotSince(w io.Writer, since SnapshotToken) (SnapshotToken, error) {
+	token, err := c.s.Load().SnapshotSince(w, since, c.opt)
+	if err != nil {
+		return SnapshotToken{}, errors.WithStack(err)
+	}
+	return token, nil
+}
+
+// ApplyDelta layers a snapshot written by SnapshotSince onto the map.
+// the first delta is taken with a zero token and applied onto an empty map, the next ones must be applied in the order they were taken.
+// a delta that does not follow the last one applied to this map (out of order, skipped) fails with ErrDeltaMismatch,
+// a delta that fails partway leaves the map partly applied, only a delta taken with a zero token can follow it.
+// the last applied delta is kept in memory only, a map reopened by Open starts over from a zero token delta.
+func (c *Map[V]) ApplyDelta(r io.Reader) error {
+	c.reshardMutex.Lock()
+	defer c.reshardMutex.Unlock()
+
+	token, err := c.s.Load().ApplyDelta(r, c.applied, c.opt)
+	c.applied = token
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// Subscribe returns a subscription to the mutations of the map, starting right after the snapshot of since
+// (the records appended since are sent first), or from now with a zero token.
+// a subscriber that does not keep up with the writers is ended with ErrLagged instead of blocking them.
+func (c *Map[V]) Subscribe(since SnapshotToken) *Subscription {
+	c.reshardMutex.Lock()
+	defer c.reshardMutex.Unlock()
+
+	return c.subs.subscribe(c.s.Load(), since, c.opt.subscriptionBuffer)
+}
+
+func (c *Map[V]) ReclaimableSpace() uint64 {
+	sum := uint64(0)
+	for _, m := range c.s.Load().Shards() {
+		sum += m.ReclaimableSpace()
+	}
+	return sum
+}
+
+func (c *Map[V]) Size() uint64 {
+	sum := uint64(0)
+	for _, m := range c.s.Load().Shards() {
+		sum += m.Size()
+	}
+	return sum
+}
+
+func (c *Map[V]) Compact() error {
+	for _, m := range c.s.Load().Shards() {
+		if err := m.Compact(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// Sync flushes all segment files of a map opened by Open to disk.
+func (c *Map[V]) Sync() error {
+	for _, m := range c.s.Load().Shards() {
+		if err := m.Sync(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func (c *Map[V]) runSync(interval time.Duration) {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			for _, m := range c.s.Load().Shards() {
+				if err := m.Sync(); err != nil {
+					c.opt.errorHandler("Sync", "", err)
+				}
+			}
+		}
+	}
+}
+
+// ReapExpired removes the keys expired by now from all shards and returns the number of removed keys.
+func (c *Map[V]) ReapExpired() (int, error) {
+	now := time.Now()
+	count := 0
+	for _, m := range c.s.Load().Shards() {
+		m.Lock()
+		if m.retired {
+			// replaced by Reshard, the next tick reaps the new shards
+			m.Unlock()
+			continue
+		}
+		n, err := m.ReapExpired(now)
+		m.Unlock()
+		count += n
+		if err != nil {
+			return count, errors.WithStack(err)
+		}
+	}
+	return count, nil
+}
+
+func (c *Map[V]) runReaper(interval time.Duration) {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if _, err := c.ReapExpired(); err != nil {
+				c.opt.errorHandler("ReapExpired", "", err)
+			}
+		}
+	}
+}
+
+func (c *Map[V]) runAutoCompact(policy CompactPolicy) {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(policy.interval)
+	defer ticker.Stop()
+
+	concurrency := policy.concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.compactShards(policy, sem)
+		}
+	}
+}
+
+// compactShards compacts the shards that pass the threshold of policy, at most cap(sem) at a time.
+func (c *Map[V]) compactShards(policy CompactPolicy, sem chan struct{}) {
+	wg := new(sync.WaitGroup)
+	defer wg.Wait()
+
+	for _, m := range c.s.Load().Shards() {
+		if policy.needsCompact(m.ReclaimableSpace(), m.Size()) != true {
+			continue
+		}
+		select {
+		case <-c.done:
+			return
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(m *walCache) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := m.Compact(); err != nil && errors.Is(err, ErrCompactRunning) != true {
+				c.opt.errorHandler("Compact", "", err)
+			}
+		}(m)
+	}
+}
+
+// Close stops background workers and releases the segment files of a map opened by Open.
+// pending writes are flushed before the files are closed, later writes fail with ErrClosed.
+func (c *Map[V]) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.subs.endAll(nil)
+	})
+	c.wg.Wait()
+
+	if err := c.s.Load().Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// Reshard redistributes all records into size shards, size must be at least 1.
+// every shard is locked until it completes, so both reads and mutations wait in the meantime.
+// maps opened by Open cannot be resharded (ErrReshardDurable), their shard size is fixed by the segment files in dir.
+func (c *Map[V]) Reshard(size int) error {
+	if err := checkShardSize(size); err != nil {
+		return errors.WithStack(err)
+	}
+
+	c.reshardMutex.Lock()
+	defer c.reshardMutex.Unlock()
+
+	old := c.s.Load()
+	if old.durable() {
+		return errors.WithStack(ErrReshardDurable)
+	}
+
+	for _, m := range old.Shards() {
+		m.Lock()
+	}
+	defer func() {
+		for _, m := range old.Shards() {
+			m.Unlock()
+		}
+	}()
+
+	s, err := rebalanceShards(old.Shards(), size, c.opt)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, m := range old.Shards() {
+		m.retired = true
+	}
+	// the positions of the events no longer exist, end the subscriptions before any write reaches the new shards
+	c.subs.endAll(errors.Wrap(ErrLagged, "resharded"))
+	c.subs.watch(s)
+	c.s.Store(s)
+	return nil
+}
+
+// RestoreMap restores a Map from a snapshot taken by a Map with the same kind of ValueCodec.
+func RestoreMap[V any](r io.Reader, valueCodec ValueCodec[V], funcs ...walmapOptFunc) (*Map[V], error) {
+	opt := newOption(valueCodecIDOf(valueCodec), funcs...)
+	s, err := restoreShards(r, opt)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return newMap(s, opt, valueCodec), nil
+}
+
+// OpenMap is the Map version of Open.
+func OpenMap[V any](dir string, valueCodec ValueCodec[V], funcs ...walmapOptFunc) (*Map[V], error) {
+	opt := newOption(valueCodecIDOf(valueCodec), funcs...)
+	if err := opt.syncPolicy.validate(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s, err := openShards(dir, opt)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	c := newMap(s, opt, valueCodec)
+	if opt.syncPolicy.mode == syncModeInterval {
+		c.wg.Add(1)
+		go c.runSync(opt.syncPolicy.interval)
+	}
+	return c, nil
+}
+
+func NewMap[V any](valueCodec ValueCodec[V], funcs ...walmapOptFunc) *Map[V] {
+	opt := newOption(valueCodecIDOf(valueCodec), funcs...)
+	if err := checkShardSize(opt.shardSize); err != nil {
+		// NewMap has no error return, report it and keep the map usable
+		opt.errorHandler("NewMap", "", err)
+		opt.shardSize = defaultShardSize
+	}
+	s := newShards(opt)
+	return newMap(s, opt, valueCodec)
+}
+
+func newMap[V any](s *shards, opt *walmapOpt, valueCodec ValueCodec[V]) *Map[V] {
+	c := &Map[V]{
+		opt:          opt,
+		codec:        valueCodec,
+		reshardMutex: new(sync.Mutex),
+		done:         make(chan struct{}),
+		wg:           new(sync.WaitGroup),
+		closeOnce:    new(sync.Once),
+		subs:         newSubscribers(),
+	}
+	c.subs.watch(s)
+	c.s.Store(s)
+	if 0 < opt.reapInterval {
+		c.wg.Add(1)
+		go c.runReaper(opt.reapInterval)
+	}
+	if opt.compactPolicy.enabled() {
+		c.wg.Add(1)
+		go c.runAutoCompact(opt.compactPolicy)
+	}
+	return c
+}
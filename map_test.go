@@ -0,0 +1,282 @@
+package walmap
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/octu0/walmap/codec"
+)
+
+func TestMapSetGet(t *testing.T) {
+	m := NewMap(JSONCodec[testJSONValue](), WithShardSize(8))
+	m.Set("foo", testJSONValue{"foo", 1})
+	m.Set("bar", testJSONValue{"bar", 2})
+
+	if v, ok := m.Get("foo"); ok != true {
+		t.Errorf("exists")
+	} else if v.Name != "foo" || v.Age != 1 {
+		t.Errorf("actual: %+v", v)
+	}
+	if _, ok := m.Get("baz"); ok {
+		t.Errorf("not exists")
+	}
+
+	v := m.Upsert("foo", func(exists bool, oldValue testJSONValue) testJSONValue {
+		if exists != true {
+			t.Errorf("exists")
+		}
+		oldValue.Age += 10
+		return oldValue
+	})
+	if v.Age != 11 {
+		t.Errorf("actual: %+v", v)
+	}
+	if m.SetIfAbsent("foo", testJSONValue{}) {
+		t.Errorf("already exists")
+	}
+	if m.SetIfAbsent("baz", testJSONValue{"baz", 3}) != true {
+		t.Errorf("absent")
+	}
+	if m.RemoveIf("bar", func(exists bool, value testJSONValue) bool { return value.Age == 2 }) != true {
+		t.Errorf("removed")
+	}
+	if removed, ok := m.Remove("baz"); ok != true {
+		t.Errorf("removed")
+	} else if removed.Name != "baz" {
+		t.Errorf("actual: %+v", removed)
+	}
+	if m.Len() != 1 {
+		t.Errorf("actual: %d", m.Len())
+	}
+}
+
+func TestMapSnapshotRestore(t *testing.T) {
+	m1 := NewMap(StringCodec(), WithShardSize(8))
+	m1.Set("foo", "bar")
+	m1.Set("hello", "world")
+
+	out := bytes.NewBuffer(nil)
+	if err := m1.Snapshot(out); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+
+	m2, err := RestoreMap(bytes.NewReader(out.Bytes()), StringCodec())
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	if v, ok := m2.Get("hello"); ok != true {
+		t.Errorf("exists")
+	} else if v != "world" {
+		t.Errorf("actual: %s", v)
+	}
+
+	if _, err := RestoreMap(bytes.NewReader(out.Bytes()), BytesCodec()); errors.Is(err, ErrValueCodecMismatch) != true {
+		t.Errorf("value codec mismatch: %+v", err)
+	}
+	if _, err := Restore(bytes.NewReader(out.Bytes())); errors.Is(err, ErrValueCodecMismatch) != true {
+		t.Errorf("value codec mismatch: %+v", err)
+	}
+}
+
+func TestOpenMap(t *testing.T) {
+	dir := t.TempDir()
+
+	m1, err := OpenMap(dir, BytesCodec(), WithShardSize(4))
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	m1.Set("foo", []byte("bar"))
+	if err := m1.Close(); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+
+	m2, err := OpenMap(dir, BytesCodec(), WithShardSize(4))
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	defer m2.Close()
+
+	if v, ok := m2.Get("foo"); ok != true {
+		t.Errorf("exists")
+	} else if bytes.Equal(v, []byte("bar")) != true {
+		t.Errorf("actual: %s", v)
+	}
+}
+
+func TestMapBytes(t *testing.T) {
+	t.Run("walmap", func(tt *testing.T) {
+		m := New(WithShardSize(4))
+		m.SetBytes("raw", []byte("protobuf"))
+		m.Set("gob", "value")
+
+		v, ok := m.Get("raw")
+		if ok != true {
+			tt.Errorf("exists")
+		}
+		if b, ok := v.([]byte); ok != true {
+			tt.Errorf("type: %T", v)
+		} else if bytes.Equal(b, []byte("protobuf")) != true {
+			tt.Errorf("actual: %s", b)
+		}
+
+		data, ok := m.GetBytes("raw")
+		if ok != true {
+			tt.Errorf("exists")
+		}
+		if bytes.Equal(data, []byte("protobuf")) != true {
+			tt.Errorf("actual: %s", data)
+		}
+		if _, ok := m.GetBytes("gob"); ok != true {
+			tt.Errorf("encoded value exists")
+		}
+
+		viewed := false
+		found := m.ViewBytes("raw", func(data []byte) {
+			viewed = bytes.Equal(data, []byte("protobuf"))
+		})
+		if found != true || viewed != true {
+			tt.Errorf("view found=%v viewed=%v", found, viewed)
+		}
+		if m.ViewBytes("notfound", func([]byte) { tt.Errorf("not called") }) {
+			tt.Errorf("not found")
+		}
+
+		removed, ok := m.Remove("raw")
+		if ok != true {
+			tt.Errorf("removed")
+		}
+		if b, ok := removed.([]byte); ok != true || bytes.Equal(b, []byte("protobuf")) != true {
+			tt.Errorf("actual: %v", removed)
+		}
+	})
+	t.Run("string", func(tt *testing.T) {
+		m := NewMap(StringCodec(), WithShardSize(4))
+		m.SetBytes("raw", []byte("hello"))
+
+		if v, ok := m.Get("raw"); ok != true {
+			tt.Errorf("exists")
+		} else if v != "hello" {
+			tt.Errorf("actual: %s", v)
+		}
+	})
+	t.Run("compact/restore", func(tt *testing.T) {
+		m1 := New(WithShardSize(1))
+		m1.SetBytes("raw", []byte("data"))
+		m1.Set("gob", "value")
+		m1.Set("gob", "value2")
+		if err := m1.Compact(); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+
+		out := bytes.NewBuffer(nil)
+		if err := m1.Snapshot(out); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		m2, err := Restore(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		for _, m := range []*WALMap{m1, m2} {
+			v, ok := m.Get("raw")
+			if ok != true {
+				tt.Errorf("exists")
+			}
+			if b, ok := v.([]byte); ok != true || bytes.Equal(b, []byte("data")) != true {
+				tt.Errorf("actual: %v", v)
+			}
+		}
+	})
+}
+
+func BenchmarkMapBytes(b *testing.B) {
+	value := bytes.Repeat([]byte("a"), 256)
+
+	b.Run("walmap/Set/Get", func(tb *testing.B) {
+		m := New()
+		tb.ResetTimer()
+		for i := 0; i < tb.N; i += 1 {
+			m.Set("key", value)
+			if _, ok := m.Get("key"); ok != true {
+				tb.Fatalf("exists")
+			}
+		}
+	})
+	b.Run("walmap/SetBytes/ViewBytes", func(tb *testing.B) {
+		m := New()
+		tb.ResetTimer()
+		for i := 0; i < tb.N; i += 1 {
+			m.SetBytes("key", value)
+			if m.ViewBytes("key", func([]byte) {}) != true {
+				tb.Fatalf("exists")
+			}
+		}
+	})
+}
+
+func TestMapErrors(t *testing.T) {
+	type handled struct {
+		op  string
+		key string
+		err error
+	}
+	corruptLast := func(m *WALMap, key string) {
+		c := m.s.Load().GetShard(key)
+		c.log.mutex.Lock()
+		defer c.log.mutex.Unlock()
+
+		buf := c.log.buf.Bytes()
+		buf[len(buf)-1] ^= 0xff
+	}
+
+	t.Run("corrupt", func(tt *testing.T) {
+		errs := make([]handled, 0)
+		m := New(WithShardSize(1), WithErrorHandler(func(op, key string, err error) {
+			errs = append(errs, handled{op, key, err})
+		}))
+		m.Set("foo", "bar")
+		corruptLast(m, "foo")
+
+		if _, ok, err := m.GetE("foo"); errors.Is(err, codec.ErrCorruptRecord) != true {
+			tt.Errorf("corrupt: ok=%v %+v", ok, err)
+		}
+		if _, ok := m.Get("foo"); ok {
+			tt.Errorf("corrupt record is not returned")
+		}
+		if len(errs) != 1 {
+			tt.Fatalf("actual: %v", errs)
+		}
+		if errs[0].op != "Get" || errs[0].key != "foo" || errors.Is(errs[0].err, codec.ErrCorruptRecord) != true {
+			tt.Errorf("actual: %+v", errs[0])
+		}
+		if _, ok, err := m.RemoveE("foo"); errors.Is(err, codec.ErrCorruptRecord) != true {
+			tt.Errorf("corrupt: ok=%v %+v", ok, err)
+		}
+		if _, ok, err := m.GetE("notfound"); err != nil || ok {
+			tt.Errorf("missing key is not error: ok=%v %+v", ok, err)
+		}
+	})
+	t.Run("encode", func(tt *testing.T) {
+		m := New(WithShardSize(1))
+		if err := m.SetE("func", func() {}); err == nil {
+			tt.Errorf("gob can not encode func")
+		}
+		if _, ok := m.Get("func"); ok {
+			tt.Errorf("not stored")
+		}
+	})
+	t.Run("logger", func(tt *testing.T) {
+		out := bytes.NewBuffer(nil)
+		m := New(WithShardSize(1), WithLogger(slog.New(slog.NewJSONHandler(out, nil))))
+		m.Set("func", func() {})
+
+		if strings.Contains(out.String(), `"key":"func"`) != true {
+			tt.Errorf("actual: %s", out.String())
+		}
+		if strings.Contains(out.String(), `"op":"Set"`) != true {
+			tt.Errorf("actual: %s", out.String())
+		}
+	})
+}
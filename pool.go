@@ -6,7 +6,8 @@ import (
 )
 
 const (
-	defaultBufferSize int = 16 * 1024
+	defaultBufferSize    int = 16 * 1024
+	defaultMaxBufferSize int = 1024 * 1024
 )
 
 type BufferPool interface {
@@ -19,22 +20,37 @@ var (
 )
 
 type defaultBufferPool struct {
-	pool *sync.Pool
+	pool    *sync.Pool
+	maxSize int
 }
 
 func (d *defaultBufferPool) Get() *bytes.Buffer {
 	return d.pool.Get().(*bytes.Buffer)
 }
 
+// Put drops buf instead of keeping it when it has grown beyond the max size of the pool.
 func (d *defaultBufferPool) Put(buf *bytes.Buffer) {
+	if d.maxSize < buf.Cap() {
+		return
+	}
 	d.pool.Put(buf)
 }
 
-func newDefaultBufferPool() *defaultBufferPool {
+// NewBufferPool returns a BufferPool of buffers allocated with initialSize,
+// buffers grown beyond maxSize are not returned to the pool.
+func NewBufferPool(initialSize, maxSize int) BufferPool {
+	return newBufferPool(initialSize, maxSize)
+}
+
+func newBufferPool(initialSize, maxSize int) *defaultBufferPool {
 	pool := &sync.Pool{
 		New: func() any {
-			return bytes.NewBuffer(make([]byte, 0, defaultBufferSize))
+			return bytes.NewBuffer(make([]byte, 0, initialSize))
 		},
 	}
-	return &defaultBufferPool{pool}
+	return &defaultBufferPool{pool, maxSize}
+}
+
+func newDefaultBufferPool() *defaultBufferPool {
+	return newBufferPool(defaultBufferSize, defaultMaxBufferSize)
 }
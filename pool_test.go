@@ -0,0 +1,23 @@
+package walmap
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBufferPoolMaxSize(t *testing.T) {
+	pool := NewBufferPool(16, 64)
+
+	large := bytes.NewBuffer(make([]byte, 0, 1024))
+	pool.Put(large)
+	for i := 0; i < 10; i += 1 {
+		if buf := pool.Get(); buf == large {
+			t.Errorf("oversized buffer must be dropped")
+		}
+	}
+
+	buf := pool.Get()
+	if 64 < buf.Cap() {
+		t.Errorf("actual: %d", buf.Cap())
+	}
+}
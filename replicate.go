@@ -0,0 +1,198 @@
+package walmap
+
+import (
+	"bufio"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/octu0/walmap/codec"
+	"github.com/pkg/errors"
+)
+
+// replication stream: a frame type byte, the leader's clock (unix nano) and the payload of the frame.
+const (
+	frameSnapshot  uint8 = 'S' // payload: a snapshot written by SnapshotSince with a zero token
+	frameRecord    uint8 = 'R' // payload: an encoded record framed by encodeData
+	frameHeartbeat uint8 = 'H' // no payload, every record before it has been sent
+)
+
+const (
+	defaultHeartbeatInterval time.Duration = time.Second
+)
+
+var (
+	ErrReplicationProtocol      = errors.New("unexpected replication frame")
+	ErrInvalidHeartbeatInterval = errors.New("heartbeat interval must be positive")
+)
+
+func writeFrame(w *bufio.Writer, kind uint8, t time.Time) error {
+	if err := w.WriteByte(kind); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := writeUint64(w, uint64(t.UnixNano())); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// Replicate streams the map to a Follower reading from w: a snapshot first and then every mutation as it happens,
+// with a heartbeat every interval of WithHeartbeatInterval while idle.
+// it returns nil when the map is closed, ErrLagged when w does not keep up (the follower has to reconnect) or the error of w.
+// it fails with ErrInvalidHeartbeatInterval before writing anything when the interval is not positive.
+func (c *Map[V]) Replicate(w io.Writer) error {
+	if c.opt.heartbeatInterval <= 0 {
+		return errors.Wrapf(ErrInvalidHeartbeatInterval, "interval %s", c.opt.heartbeatInterval)
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := writeFrame(bw, frameSnapshot, time.Now()); err != nil {
+		return errors.WithStack(err)
+	}
+	token, err := c.SnapshotSince(bw, SnapshotToken{})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	sub := c.Subscribe(token)
+	defer sub.Close()
+
+	if err := bw.Flush(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	ticker := time.NewTicker(c.opt.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ev, ok := <-sub.Events():
+			if ok != true {
+				if err := sub.Err(); err != nil {
+					return errors.WithStack(err)
+				}
+				return nil
+			}
+			if err := writeFrame(bw, frameRecord, ev.Time); err != nil {
+				return errors.WithStack(err)
+			}
+			if err := encodeData(bw, ev.Record); err != nil {
+				return errors.WithStack(err)
+			}
+			if len(sub.Events()) == 0 {
+				if err := bw.Flush(); err != nil {
+					return errors.WithStack(err)
+				}
+			}
+		case now := <-ticker.C:
+			if 0 < len(sub.Events()) {
+				// the pending records carry their own time
+				continue
+			}
+			if err := writeFrame(bw, frameHeartbeat, now); err != nil {
+				return errors.WithStack(err)
+			}
+			if err := bw.Flush(); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+}
+
+// applyRecord writes a record encoded by another map as is, tombstones delete the key.
+func (c *Map[V]) applyRecord(key string, record []byte) error {
+	m := c.lockShard(key)
+	defer m.Unlock()
+
+	if err := m.log.applyRecords(record); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// Follower applies the stream written by Map.Replicate to a local map.
+type Follower struct {
+	r            *bufio.Reader
+	applyDelta   func(r io.Reader) error
+	applyRecord  func(key string, record []byte) error
+	bootstrapped *atomic.Bool
+	applied      *atomic.Uint64
+	leaderTime   *atomic.Int64
+}
+
+// Run applies the stream until it ends, it returns nil at the end of the stream (e.g. the connection closed by the leader).
+// the snapshot at the head of the stream replaces the content of the map, so a follower can reconnect with a new stream.
+func (f *Follower) Run() error {
+	for {
+		kind, err := f.r.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return errors.WithStack(err)
+		}
+		t, err := readUint64(f.r)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		switch kind {
+		case frameSnapshot:
+			if err := f.applyDelta(f.r); err != nil {
+				return errors.WithStack(err)
+			}
+			f.bootstrapped.Store(true)
+		case frameRecord:
+			if f.bootstrapped.Load() != true {
+				return errors.Wrap(ErrReplicationProtocol, "record before snapshot")
+			}
+			record, err := decodeData(f.r)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			_, key, _, err := codec.DecodeView(record)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if err := f.applyRecord(string(key), record); err != nil {
+				return errors.WithStack(err)
+			}
+			f.applied.Add(1)
+		case frameHeartbeat:
+		default:
+			return errors.Wrapf(ErrReplicationProtocol, "frame %d", kind)
+		}
+		f.leaderTime.Store(int64(t))
+	}
+}
+
+// Bootstrapped reports whether the snapshot at the head of the stream has been applied.
+func (f *Follower) Bootstrapped() bool {
+	return f.bootstrapped.Load()
+}
+
+// Applied returns the number of records applied after the snapshot.
+func (f *Follower) Applied() uint64 {
+	return f.applied.Load()
+}
+
+// Lag returns how far behind the leader the follower is: the age of the last applied record,
+// or of the last heartbeat when it is up to date. it relies on the clocks of both hosts being in sync.
+func (f *Follower) Lag() time.Duration {
+	t := f.leaderTime.Load()
+	if t == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, t))
+}
+
+// NewFollower returns a Follower applying the stream of r to m, which must have the shard size and hash function of the leader.
+func NewFollower[V any](m *Map[V], r io.Reader) *Follower {
+	return &Follower{
+		r:            bufio.NewReader(r),
+		applyDelta:   m.ApplyDelta,
+		applyRecord:  m.applyRecord,
+		bootstrapped: new(atomic.Bool),
+		applied:      new(atomic.Uint64),
+		leaderTime:   new(atomic.Int64),
+	}
+}
@@ -0,0 +1,154 @@
+package walmap
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func testWaitFor(t *testing.T, fn func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for fn() != true {
+		if deadline.Before(time.Now()) {
+			t.Fatalf("timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFollower(t *testing.T) {
+	leader := New(WithShardSize(4), WithHeartbeatInterval(10*time.Millisecond))
+	for i := 0; i < 100; i += 1 {
+		leader.Set("key"+strconv.Itoa(i), i)
+	}
+	replica := New(WithShardSize(4))
+	replica.Set("stale", "removed by the snapshot")
+
+	leaderConn, followerConn := net.Pipe()
+	replicated := make(chan error, 1)
+	go func() {
+		replicated <- leader.Replicate(leaderConn)
+		leaderConn.Close()
+	}()
+	follower := NewFollower(replica.Map, followerConn)
+	followed := make(chan error, 1)
+	go func() {
+		followed <- follower.Run()
+	}()
+
+	t.Run("bootstrap", func(tt *testing.T) {
+		testWaitFor(tt, follower.Bootstrapped)
+		testSameContent(tt, leader, replica)
+		if _, ok := replica.Get("stale"); ok {
+			tt.Errorf("snapshot replaces the content")
+		}
+	})
+	t.Run("tail", func(tt *testing.T) {
+		leader.Set("key1", "updated")
+		leader.SetBytes("raw", []byte("bytes"))
+		leader.Remove("key2")
+		testWaitFor(tt, func() bool {
+			return follower.Applied() == 3
+		})
+		testSameContent(tt, leader, replica)
+		if v, ok := replica.GetBytes("raw"); ok != true || string(v) != "bytes" {
+			tt.Errorf("actual: %s %v", v, ok)
+		}
+	})
+	t.Run("lag", func(tt *testing.T) {
+		// heartbeats keep the lag of an idle follower small
+		time.Sleep(50 * time.Millisecond)
+		if lag := follower.Lag(); lag <= 0 || time.Second < lag {
+			tt.Errorf("actual: %s", lag)
+		}
+	})
+	t.Run("close", func(tt *testing.T) {
+		if err := leader.Close(); err != nil {
+			tt.Errorf("no error: %+v", err)
+		}
+		if err := <-replicated; err != nil {
+			tt.Errorf("no error: %+v", err)
+		}
+		if err := <-followed; err != nil {
+			tt.Errorf("no error: %+v", err)
+		}
+	})
+}
+
+func TestFollowerReconnect(t *testing.T) {
+	leader := New(WithShardSize(4))
+	defer leader.Close()
+	replica := New(WithShardSize(4))
+
+	follow := func(tt *testing.T) {
+		leaderConn, followerConn := net.Pipe()
+		defer followerConn.Close()
+
+		replicated := make(chan error, 1)
+		go func() {
+			replicated <- leader.Replicate(leaderConn)
+		}()
+		follower := NewFollower(replica.Map, followerConn)
+		go follower.Run()
+
+		testWaitFor(tt, follower.Bootstrapped)
+		testSameContent(tt, leader, replica)
+
+		// the leader stops replicating when the follower is gone
+		followerConn.Close()
+		leader.Set("wake", "up")
+		if err := <-replicated; err == nil {
+			tt.Errorf("closed connection must fail")
+		}
+	}
+
+	leader.Set("a", "1")
+	t.Run("first", follow)
+	leader.Set("b", "2")
+	leader.Remove("a")
+	t.Run("second", follow)
+}
+
+func TestFollowerProtocol(t *testing.T) {
+	t.Run("record before snapshot", func(tt *testing.T) {
+		stream := bytes.NewBuffer(nil)
+		stream.WriteByte(frameRecord)
+		writeUint64(stream, uint64(time.Now().UnixNano()))
+
+		err := NewFollower(New().Map, stream).Run()
+		if errors.Is(err, ErrReplicationProtocol) != true {
+			tt.Errorf("actual: %+v", err)
+		}
+	})
+	t.Run("shard size", func(tt *testing.T) {
+		stream := bytes.NewBuffer(nil)
+		stream.WriteByte(frameSnapshot)
+		writeUint64(stream, uint64(time.Now().UnixNano()))
+		if _, err := New(WithShardSize(4)).SnapshotSince(stream, SnapshotToken{}); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+
+		err := NewFollower(New(WithShardSize(8)).Map, stream).Run()
+		if errors.Is(err, ErrDeltaMismatch) != true {
+			tt.Errorf("actual: %+v", err)
+		}
+	})
+}
+
+func TestReplicateHeartbeatInterval(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Second} {
+		m := New(WithShardSize(2), WithHeartbeatInterval(interval))
+		out := bytes.NewBuffer(nil)
+		if err := m.Replicate(out); errors.Is(err, ErrInvalidHeartbeatInterval) != true {
+			t.Errorf("interval=%s actual: %+v", interval, err)
+		}
+		if out.Len() != 0 {
+			t.Errorf("nothing written: %d", out.Len())
+		}
+		m.Close()
+	}
+}
@@ -0,0 +1,168 @@
+package walmap
+
+import (
+	"bytes"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testCountingBufferPool struct {
+	BufferPool
+	gets *atomic.Int64
+}
+
+func (p testCountingBufferPool) Get() *bytes.Buffer {
+	p.gets.Add(1)
+	return p.BufferPool.Get()
+}
+
+// testWriteAfter mutates m in every way a map supports and verifies the result, including through another snapshot.
+func testWriteAfter(t *testing.T, m *WALMap, funcs ...walmapOptFunc) {
+	for i := 0; i < 100; i += 1 {
+		m.Set("set"+strconv.Itoa(i), "v"+strconv.Itoa(i))
+	}
+	if err := m.SetE("setE", "v"); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	m.SetBytes("bytes", []byte("raw"))
+	m.SetWithTTL("ttl", "v", time.Hour)
+	m.Upsert("upsert", func(exists bool, oldValue any) any {
+		return "upserted"
+	})
+	m.SetIfAbsent("absent", "v")
+	m.Remove("set0")
+	m.RemoveIf("set1", func(exists bool, value any) bool {
+		return exists
+	})
+	if err := m.Compact(); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+
+	verify := func(name string, m *WALMap) {
+		if v, ok := m.Get("set2"); ok != true || v.(string) != "v2" {
+			t.Errorf("%s: set2 actual: %v %v", name, v, ok)
+		}
+		if _, ok := m.Get("set0"); ok {
+			t.Errorf("%s: set0 must be removed", name)
+		}
+		if _, ok := m.Get("set1"); ok {
+			t.Errorf("%s: set1 must be removed", name)
+		}
+		if v, ok := m.GetBytes("bytes"); ok != true || string(v) != "raw" {
+			t.Errorf("%s: bytes actual: %s %v", name, v, ok)
+		}
+		if v, ok := m.Get("upsert"); ok != true || v.(string) != "upserted" {
+			t.Errorf("%s: upsert actual: %v %v", name, v, ok)
+		}
+		for _, key := range []string{"setE", "ttl", "absent"} {
+			if _, ok := m.Get(key); ok != true {
+				t.Errorf("%s: %s must exist", name, key)
+			}
+		}
+	}
+	verify("written", m)
+
+	out := bytes.NewBuffer(nil)
+	if err := m.Snapshot(out); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	restored, err := Restore(out, funcs...)
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	verify("restored", restored)
+}
+
+func TestRoundTripWriteAfterRestore(t *testing.T) {
+	snapshotOf := func(tt *testing.T, funcs ...walmapOptFunc) *bytes.Buffer {
+		m := New(funcs...)
+		for i := 0; i < 100; i += 1 {
+			m.Set("init"+strconv.Itoa(i), i)
+		}
+		m.Remove("init0")
+		out := bytes.NewBuffer(nil)
+		if err := m.Snapshot(out); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name     string
+		snapshot []walmapOptFunc
+		restore  []walmapOptFunc
+	}{
+		{"default", nil, nil},
+		{"shard size", []walmapOptFunc{WithShardSize(4)}, []walmapOptFunc{WithShardSize(4)}},
+		{"resize", []walmapOptFunc{WithShardSize(4)}, []walmapOptFunc{WithShardSize(7)}},
+		{"rebalance", []walmapOptFunc{WithShardSize(4)}, []walmapOptFunc{WithShardSize(4), WithHashFunc(testFNVHashFunc{}), WithRebalance()}},
+		{"recovery", []walmapOptFunc{WithShardSize(4)}, []walmapOptFunc{WithShardSize(4), WithRecovery(func(int, Recovery) {})}},
+		{"concurrency", []walmapOptFunc{WithShardSize(4)}, []walmapOptFunc{WithShardSize(4), WithConcurrency(4)}},
+		{"options", []walmapOptFunc{WithShardSize(4)}, []walmapOptFunc{WithShardSize(4), WithCacheCapacity(8), WithInitialLogSize(64), WithInitialIndexSize(8)}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(tt *testing.T) {
+			m, err := Restore(snapshotOf(tt, tc.snapshot...), tc.restore...)
+			if err != nil {
+				tt.Fatalf("no error: %+v", err)
+			}
+			if m.Len() != 99 {
+				tt.Errorf("actual: %d", m.Len())
+			}
+			testWriteAfter(tt, m, tc.restore...)
+		})
+	}
+
+	t.Run("reshard", func(tt *testing.T) {
+		m, err := Restore(snapshotOf(tt, WithShardSize(4)), WithShardSize(4))
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if err := m.Reshard(9); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		testWriteAfter(tt, m, WithShardSize(9))
+	})
+	t.Run("open", func(tt *testing.T) {
+		dir := tt.TempDir()
+		m1, err := Open(dir, WithShardSize(4))
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		m1.Set("init", "v")
+		if err := m1.Close(); err != nil {
+			tt.Errorf("no error: %+v", err)
+		}
+
+		m2, err := Open(dir, WithShardSize(4))
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		defer m2.Close()
+
+		testWriteAfter(tt, m2, WithShardSize(4))
+	})
+	t.Run("buffer pool", func(tt *testing.T) {
+		pool := testCountingBufferPool{NewBufferPool(16, 1024), new(atomic.Int64)}
+		m, err := Restore(snapshotOf(tt, WithShardSize(4)), WithShardSize(4), WithBufferPool(pool))
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		m.Set("key", "value")
+		if pool.gets.Load() == 0 {
+			tt.Errorf("restored map must use the buffer pool of the option")
+		}
+	})
+	t.Run("hash func", func(tt *testing.T) {
+		m, err := Restore(snapshotOf(tt, WithShardSize(4), WithHashFunc(testFNVHashFunc{})), WithShardSize(4), WithHashFunc(testFNVHashFunc{}))
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if _, ok := m.s.Load().hash.(testFNVHashFunc); ok != true {
+			tt.Errorf("restored map must use the hash func of the option")
+		}
+		testWriteAfter(tt, m, WithShardSize(4), WithHashFunc(testFNVHashFunc{}))
+	})
+}
@@ -0,0 +1,116 @@
+package walmap
+
+import (
+	"container/heap"
+
+	"github.com/pkg/errors"
+)
+
+// scanBatchSize is the number of keys a shard cursor reads per read lock.
+const scanBatchSize int = 256
+
+// scanCursor walks the keys of one shard in order, a batch at a time, so the shard is not locked while fn runs.
+type scanCursor struct {
+	cache *walCache
+	next  string
+	end   string
+	keys  []string
+	pos   int
+	more  bool
+}
+
+func (c *scanCursor) key() string {
+	return c.keys[c.pos]
+}
+
+// advance moves to the next key, reading the next batch when needed, and returns false when the shard is done.
+func (c *scanCursor) advance() bool {
+	c.pos += 1
+	for len(c.keys) <= c.pos {
+		if c.more != true {
+			return false
+		}
+		c.fill()
+	}
+	return true
+}
+
+func (c *scanCursor) fill() {
+	c.keys, c.more = c.cache.log.scanKeys(c.next, c.end, scanBatchSize)
+	c.pos = 0
+	if 0 < len(c.keys) {
+		// smallest key after the last one
+		c.next = c.keys[len(c.keys)-1] + "\x00"
+	}
+}
+
+type scanHeap []*scanCursor
+
+func (h scanHeap) Len() int           { return len(h) }
+func (h scanHeap) Less(i, j int) bool { return h[i].key() < h[j].key() }
+func (h scanHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *scanHeap) Push(x any)        { *h = append(*h, x.(*scanCursor)) }
+func (h *scanHeap) Pop() any {
+	old := *h
+	n := len(old)
+	c := old[n-1]
+	*h = old[:n-1]
+	return c
+}
+
+// ScanPrefix calls fn in key order for every key that starts with prefix, until fn returns false.
+// it is Range over [prefix, the next key without prefix).
+func (c *Map[V]) ScanPrefix(prefix string, fn func(key string, value V) bool) error {
+	return c.Range(prefix, prefixEnd(prefix), fn)
+}
+
+// Range calls fn in key order for every key in [start, end), until fn returns false. an empty end means no upper bound.
+// the shards are read a batch of keys at a time and none is locked while fn runs, so fn may write to the Map.
+// a key written during the scan may or may not be seen, a key removed before fn would get to it is skipped.
+func (c *Map[V]) Range(start, end string, fn func(key string, value V) bool) error {
+	shards := c.s.Load().Shards()
+	h := make(scanHeap, 0, len(shards))
+	for _, m := range shards {
+		cursor := &scanCursor{cache: m, next: start, end: end, pos: -1, more: true}
+		if cursor.advance() {
+			h = append(h, cursor)
+		}
+	}
+	heap.Init(&h)
+
+	for 0 < h.Len() {
+		cursor := h[0]
+		key := cursor.key()
+		if cursor.advance() {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+
+		cursor.cache.RLock()
+		value, ok, err := getValueE(cursor.cache, c.codec, key)
+		cursor.cache.RUnlock()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if ok != true {
+			continue
+		}
+		if fn(key, value) != true {
+			return nil
+		}
+	}
+	return nil
+}
+
+// prefixEnd returns the smallest key greater than every key with prefix, or empty when there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; 0 <= i; i -= 1 {
+		if end[i] < 0xff {
+			end[i] += 1
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,138 @@
+package walmap
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func testScanKeys(t *testing.T, scan func(fn func(string, int) bool) error) []string {
+	keys := make([]string, 0)
+	if err := scan(func(key string, value int) bool {
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	return keys
+}
+
+func testScanExpect(t *testing.T, expect, actual []string) {
+	if len(expect) != len(actual) {
+		t.Fatalf("expect: %v actual: %v", expect, actual)
+	}
+	for i := range expect {
+		if expect[i] != actual[i] {
+			t.Errorf("[%d] expect: %s actual: %s", i, expect[i], actual[i])
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	for _, ordered := range []bool{true, false} {
+		t.Run(fmt.Sprintf("ordered=%v", ordered), func(tt *testing.T) {
+			funcs := []walmapOptFunc{WithShardSize(8)}
+			if ordered {
+				funcs = append(funcs, WithOrderedIndex())
+			}
+			m := NewMap[int](JSONCodec[int](), funcs...)
+			defer m.Close()
+			// more keys per shard than scanBatchSize
+			for i := 0; i < 3000; i += 1 {
+				m.Set(fmt.Sprintf("user:%04d", i), i)
+			}
+			m.Set("item:1", 1)
+			m.Set("user", 0)
+			m.Remove("user:0002")
+			m.SetWithTTL("user:0003", 3, time.Nanosecond)
+			time.Sleep(time.Millisecond)
+
+			expect := []string{}
+			for i := 100; i < 200; i += 1 {
+				expect = append(expect, fmt.Sprintf("user:%04d", i))
+			}
+
+			keys := testScanKeys(tt, func(fn func(string, int) bool) error {
+				return m.ScanPrefix("user:01", fn)
+			})
+			testScanExpect(tt, expect, keys)
+
+			keys = testScanKeys(tt, func(fn func(string, int) bool) error {
+				return m.Range("user:0000", "user:0005", fn)
+			})
+			testScanExpect(tt, []string{"user:0000", "user:0001", "user:0004"}, keys)
+
+			keys = testScanKeys(tt, func(fn func(string, int) bool) error {
+				return m.Range("user:2998", "", fn)
+			})
+			testScanExpect(tt, []string{"user:2998", "user:2999"}, keys)
+
+			all := testScanKeys(tt, func(fn func(string, int) bool) error {
+				return m.ScanPrefix("", fn)
+			})
+			if len(all) != 3000 {
+				tt.Errorf("actual: %d", len(all))
+			}
+			if all[0] != "item:1" || all[1] != "user" {
+				tt.Errorf("actual: %v", all[:2])
+			}
+
+			n := 0
+			if err := m.ScanPrefix("user:", func(key string, value int) bool {
+				n += 1
+				return n < 10
+			}); err != nil {
+				tt.Errorf("no error: %+v", err)
+			}
+			if n != 10 {
+				tt.Errorf("stop actual: %d", n)
+			}
+		})
+	}
+}
+
+func TestScanRestore(t *testing.T) {
+	m := NewMap[int](JSONCodec[int](), WithShardSize(4), WithOrderedIndex())
+	defer m.Close()
+	for i := 0; i < 100; i += 1 {
+		m.Set(fmt.Sprintf("k%03d", i), i)
+	}
+	out := bytes.NewBuffer(nil)
+	if err := m.Snapshot(out); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+
+	r, err := RestoreMap[int](out, JSONCodec[int](), WithShardSize(2), WithOrderedIndex())
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	defer r.Close()
+
+	keys := testScanKeys(t, func(fn func(string, int) bool) error {
+		return r.Range("k010", "k013", fn)
+	})
+	testScanExpect(t, []string{"k010", "k011", "k012"}, keys)
+
+	r.Remove("k011")
+	r.Set("k0115", 0)
+	keys = testScanKeys(t, func(fn func(string, int) bool) error {
+		return r.Range("k010", "k013", fn)
+	})
+	testScanExpect(t, []string{"k010", "k0115", "k012"}, keys)
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := map[string]string{
+		"":         "",
+		"a":        "b",
+		"user:":    "user;",
+		"a\xff":    "b",
+		"\xff\xff": "",
+	}
+	for prefix, expect := range tests {
+		if actual := prefixEnd(prefix); actual != expect {
+			t.Errorf("%q expect: %q actual: %q", prefix, expect, actual)
+		}
+	}
+}
@@ -3,20 +3,51 @@ package walmap
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"sync"
 
 	"github.com/octu0/cmap"
+	"github.com/octu0/walmap/codec"
 	"github.com/pkg/errors"
 )
 
+const (
+	segmentFileExt string = ".wal"
+)
+
+const (
+	// maxBlockSize bounds the size of a snapshot block read by decodeData, far above any shard held in memory
+	maxBlockSize uint64 = 1 << 40
+	// blockReadSize is the initial buffer of a block, larger blocks grow as they are read
+	blockReadSize uint64 = 1 * 1024 * 1024
+)
+
+var (
+	ErrShardSizeMismatch  = errors.New("shard size does not match existing segments")
+	ErrTruncatedSnapshot  = errors.New("snapshot has fewer shards than its header")
+	ErrHashFuncMismatch   = errors.New("snapshot was taken with a different hash function")
+	ErrValueCodecMismatch = errors.New("snapshot was taken with a different value codec")
+	ErrInvalidShardSize   = errors.New("shard size must be at least 1")
+)
+
+func checkShardSize(size int) error {
+	if size < 1 {
+		return errors.Wrapf(ErrInvalidShardSize, "shard size %d", size)
+	}
+	return nil
+}
+
 type shards struct {
-	caches  []*walCache
-	size    uint64
-	hash    cmap.CMapHashFunc
-	bufPool BufferPool
+	caches       []*walCache
+	size         uint64
+	hash         cmap.CMapHashFunc
+	valueCodecID uint8
 }
 
-func (s *shards) GetShard(key string) cmap.Cache {
+func (s *shards) GetShard(key string) *walCache {
 	idx := int(s.hash.Hash64(key) % s.size)
 	return s.caches[idx]
 }
@@ -25,48 +56,315 @@ func (s *shards) Shards() []*walCache {
 	return s.caches
 }
 
-func (s *shards) Snapshot(w io.Writer) error {
-	if err := encodeShardSize(w, s.size); err != nil {
-		return errors.WithStack(err)
+func (s *shards) durable() bool {
+	for _, cache := range s.caches {
+		if cache.log.path != "" {
+			return true
+		}
 	}
+	return false
+}
 
-	buf := s.bufPool.Get()
-	defer s.bufPool.Put(buf)
+func (s *shards) Snapshot(w io.Writer, opt *walmapOpt) error {
+	return s.encodeSnapshot(w, opt, func(i int) []byte {
+		return s.caches[i].log.bytes()
+	})
+}
 
+// SnapshotConsistent is like Snapshot but all shards are captured at the same instant:
+// writers are blocked only while the end of every shard's log is taken, the logs are streamed after.
+func (s *shards) SnapshotConsistent(w io.Writer, opt *walmapOpt) error {
+	logs := make([][]byte, len(s.caches))
 	for _, cache := range s.caches {
-		buf.Reset()
-		if err := cache.Snapshot(buf); err != nil {
+		cache.RLock()
+	}
+	for i, cache := range s.caches {
+		logs[i] = cache.log.bytes()
+	}
+	for _, cache := range s.caches {
+		cache.RUnlock()
+	}
+
+	return s.encodeSnapshot(w, opt, func(i int) []byte {
+		return logs[i]
+	})
+}
+
+// encodeSnapshot streams the log of each shard as is instead of copying it, writers are not blocked meanwhile.
+func (s *shards) encodeSnapshot(w io.Writer, opt *walmapOpt, logOf func(i int) []byte) error {
+	header := newSnapshotHeader(s)
+	if opt.compression != nil {
+		header.Compression = opt.compression.ID()
+	}
+	if err := encodeSnapshotHeader(w, header); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return s.encodeBlocks(w, opt, logOf)
+}
+
+// encodeBlocks writes the block of each shard, compressed with opt.compression if any.
+func (s *shards) encodeBlocks(w io.Writer, opt *walmapOpt, logOf func(i int) []byte) error {
+	if opt.compression != nil {
+		return s.encodeCompressed(w, opt, logOf)
+	}
+	for i := range s.caches {
+		if err := encodeData(w, logOf(i)); err != nil {
 			return errors.WithStack(err)
 		}
-		if err := encodeData(w, buf.Bytes()); err != nil {
-			return errors.WithStack(err)
+	}
+	return nil
+}
+
+// encodeCompressed compresses up to opt.concurrency shard blocks in parallel and writes them in order.
+func (s *shards) encodeCompressed(w io.Writer, opt *walmapOpt, logOf func(i int) []byte) error {
+	concurrency := opt.concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	bufs := make([]*bytes.Buffer, concurrency)
+	for i := range bufs {
+		bufs[i] = opt.bufferPool.Get()
+	}
+	defer func() {
+		for _, buf := range bufs {
+			opt.bufferPool.Put(buf)
+		}
+	}()
+
+	errs := make([]error, concurrency)
+	for offset := 0; offset < len(s.caches); offset += concurrency {
+		n := min(concurrency, len(s.caches)-offset)
+		wg := new(sync.WaitGroup)
+		for j := 0; j < n; j += 1 {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+
+				bufs[j].Reset()
+				errs[j] = compressBlock(bufs[j], opt.compression, logOf(offset+j))
+			}(j)
+		}
+		wg.Wait()
+
+		for j := 0; j < n; j += 1 {
+			if errs[j] != nil {
+				return errors.Wrapf(errs[j], "shard %d", offset+j)
+			}
+			if err := encodeData(w, bufs[j].Bytes()); err != nil {
+				return errors.WithStack(err)
+			}
 		}
 	}
 	return nil
 }
 
+func (s *shards) Close() error {
+	var lastErr error
+	for _, cache := range s.caches {
+		if err := cache.Close(); err != nil {
+			lastErr = errors.WithStack(err)
+		}
+	}
+	return lastErr
+}
+
 func restoreShards(r io.Reader, opt *walmapOpt) (*shards, error) {
-	shardSize, err := decodeShardSize(r)
+	header, err := decodeSnapshotHeader(r)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	shardSize := header.ShardSize
+	if shardSize < 1 {
+		return nil, errors.Wrap(ErrInvalidShardSize, "snapshot header")
+	}
+
+	if header.ValueCodec != opt.valueCodecID {
+		return nil, errors.Wrapf(ErrValueCodecMismatch, "snapshot %d, current %d", header.ValueCodec, opt.valueCodecID)
+	}
+
+	// legacy snapshots do not record the hash function, trust the caller
+	hashMismatch := header.Version != snapshotVersionLegacy && header.HashFuncID != hashFuncID(opt.hashFunc)
+	if hashMismatch && opt.rebalance != true {
+		return nil, errors.Wrapf(ErrHashFuncMismatch, "snapshot %016x, current %016x", header.HashFuncID, hashFuncID(opt.hashFunc))
+	}
+
+	if header.hasFlag(snapshotFlagDelta) {
+		return nil, errors.Wrap(ErrUnsupportedSnapshot, "delta snapshot, use ApplyDelta")
+	}
+
+	resize := opt.shardSizeSet && uint64(opt.shardSize) != shardSize
+
+	compression, err := compressionOf(header.Compression, opt)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	caches, err := restoreCaches(r, header, compression, opt)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	if uint64(len(caches)) != shardSize {
+		return nil, errors.Wrapf(ErrTruncatedSnapshot, "%d shards restored, header %d", len(caches), shardSize)
+	}
+	if resize {
+		s, err := rebalanceShards(caches, opt.shardSize, opt)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return s, nil
+	}
+	if hashMismatch {
+		s, err := rebalanceShards(caches, int(shardSize), opt)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return s, nil
+	}
+	return &shards{caches, shardSize, opt.hashFunc, opt.valueCodecID}, nil
+}
+
+// restoredShard is the result of a shard rebuilt by a worker of restoreCaches.
+type restoredShard struct {
+	cache    *walCache
+	recovery Recovery
+	err      error
+}
+
+// restoreCaches reads the shard blocks in order and rebuilds up to opt.concurrency of them in parallel.
+func restoreCaches(r io.Reader, header snapshotHeader, compression Compression, opt *walmapOpt) ([]*walCache, error) {
+	concurrency := opt.concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
 
-	caches := make([]*walCache, 0, shardSize)
+	results := make([]*restoredShard, 0, defaultShardSize)
+	sem := make(chan struct{}, concurrency)
+	wg := new(sync.WaitGroup)
 	for {
 		data, err := decodeData(r)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				break
 			}
+			wg.Wait()
 			return nil, errors.WithStack(err)
 		}
+
+		result := new(restoredShard)
+		results = append(results, result)
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result.cache, result.recovery, result.err = restoreShard(header.Version, compression, data, opt)
+		}()
+	}
+	wg.Wait()
+
+	caches := make([]*walCache, len(results))
+	for i, result := range results {
+		if result.err != nil {
+			return nil, errors.Wrapf(result.err, "shard %d", i)
+		}
+		caches[i] = result.cache
+	}
+	// reported in order and from this goroutine, fn does not need to be goroutine safe
+	for i, result := range results {
+		if 0 < result.recovery.DroppedBytes {
+			opt.recoveryFunc(i, result.recovery)
+		}
+	}
+	return caches, nil
+}
+
+func restoreShard(version uint16, compression Compression, data []byte, opt *walmapOpt) (*walCache, Recovery, error) {
+	if compression != nil {
+		decompressed, err := decompressBlock(compression, data)
+		if err != nil {
+			return nil, Recovery{}, errors.WithStack(err)
+		}
+		data = decompressed
+	}
+	if version == snapshotVersionLegacy {
+		c, err := restoreLegacyWalCache(bytes.NewReader(data), opt)
+		if err != nil {
+			return nil, Recovery{}, errors.WithStack(err)
+		}
+		return c, Recovery{}, nil
+	}
+	if opt.recoveryFunc == nil {
 		c, err := restoreWalCache(bytes.NewReader(data), opt)
+		if err != nil {
+			return nil, Recovery{}, errors.WithStack(err)
+		}
+		return c, Recovery{}, nil
+	}
+
+	c, recovery, err := recoverWalCache(bytes.NewReader(data), opt)
+	if err != nil {
+		return nil, Recovery{}, errors.WithStack(err)
+	}
+	return c, recovery, nil
+}
+
+// rebalanceShards moves the live records of caches into shardSize new shards routed by opt.hashFunc.
+// encoded records are copied as is, without decoding.
+func rebalanceShards(caches []*walCache, shardSize int, opt *walmapOpt) (*shards, error) {
+	if err := checkShardSize(shardSize); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	newOpt := *opt
+	newOpt.shardSize = shardSize
+	s := newShards(&newOpt)
+	for _, c := range caches {
+		err := c.log.rangeRecords(func(key string, record []byte) error {
+			return s.GetShard(key).log.appendRecord(key, record)
+		})
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
-		caches = append(caches, c)
 	}
-	return &shards{caches, shardSize, opt.hashFunc, opt.bufferPool}, nil
+	return s, nil
+}
+
+func openShards(dir string, opt *walmapOpt) (*shards, error) {
+	if err := checkShardSize(opt.shardSize); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+segmentFileExt))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if 0 < len(segments) && len(segments) != opt.shardSize {
+		return nil, errors.Wrapf(ErrShardSizeMismatch, "%d segments in %s, shard size %d", len(segments), dir, opt.shardSize)
+	}
+
+	caches := make([]*walCache, opt.shardSize)
+	for i := 0; i < opt.shardSize; i += 1 {
+		c, recovery, err := openWalCache(segmentPath(dir, i), opt)
+		if err != nil {
+			for _, opened := range caches[:i] {
+				opened.Close()
+			}
+			return nil, errors.WithStack(err)
+		}
+		if 0 < recovery.DroppedBytes {
+			opt.recoveryFunc(i, recovery)
+		}
+		caches[i] = c
+	}
+	return &shards{caches, uint64(opt.shardSize), opt.hashFunc, opt.valueCodecID}, nil
+}
+
+func segmentPath(dir string, idx int) string {
+	return filepath.Join(dir, fmt.Sprintf("%05d%s", idx, segmentFileExt))
 }
 
 func newShards(opt *walmapOpt) *shards {
@@ -75,7 +373,7 @@ func newShards(opt *walmapOpt) *shards {
 	for i := 0; i < opt.shardSize; i += 1 {
 		caches[i] = newWalCache(opt)
 	}
-	return &shards{caches, size64, opt.hashFunc, opt.bufferPool}
+	return &shards{caches, size64, opt.hashFunc, opt.valueCodecID}
 }
 
 func writeUint64(w io.Writer, data uint64) error {
@@ -87,27 +385,12 @@ func writeUint64(w io.Writer, data uint64) error {
 
 func readUint64(r io.Reader) (uint64, error) {
 	u64Buf := make([]byte, 8)
-	if _, err := r.Read(u64Buf); err != nil {
+	if _, err := io.ReadFull(r, u64Buf); err != nil {
 		return 0, errors.WithStack(err)
 	}
 	return binary.BigEndian.Uint64(u64Buf), nil
 }
 
-func encodeShardSize(w io.Writer, size uint64) error {
-	if err := writeUint64(w, size); err != nil {
-		return errors.WithStack(err)
-	}
-	return nil
-}
-
-func decodeShardSize(r io.Reader) (uint64, error) {
-	size, err := readUint64(r)
-	if err != nil {
-		return 0, errors.WithStack(err)
-	}
-	return size, nil
-}
-
 func encodeData(w io.Writer, data []byte) error {
 	if err := writeUint64(w, uint64(len(data))); err != nil {
 		return errors.WithStack(err)
@@ -118,15 +401,35 @@ func encodeData(w io.Writer, data []byte) error {
 	return nil
 }
 
+// decodeData reads a block written by encodeData, a damaged size is reported as codec.ErrCorruptRecord or
+// io.ErrUnexpectedEOF, the block is read as it arrives so a wrong size does not allocate up front.
 func decodeData(r io.Reader) ([]byte, error) {
 	size, err := readUint64(r)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	if maxBlockSize < size {
+		return nil, errors.Wrapf(codec.ErrCorruptRecord, "block size %d > %d", size, maxBlockSize)
+	}
 
-	data := make([]byte, size)
-	if _, err := r.Read(data); err != nil {
+	data := bytes.NewBuffer(make([]byte, 0, min(size, blockReadSize)))
+	n, err := io.CopyN(data, r, int64(size))
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.Wrapf(io.ErrUnexpectedEOF, "block size %d, read %d", size, n)
+		}
 		return nil, errors.WithStack(err)
 	}
-	return data, nil
+	return data.Bytes(), nil
+}
+
+// readFull reads the rest of a block or header that has been started, so running out of input is io.ErrUnexpectedEOF.
+func readFull(r io.Reader, buf []byte) error {
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if errors.Is(err, io.EOF) {
+			return errors.WithStack(io.ErrUnexpectedEOF)
+		}
+		return errors.WithStack(err)
+	}
+	return nil
 }
@@ -75,7 +75,7 @@ func TestShardsSnapshotRestore(t *testing.T) {
 	check(t, s1)
 
 	out := bytes.NewBuffer(nil)
-	if err := s1.Snapshot(out); err != nil {
+	if err := s1.Snapshot(out, newDefaultOption()); err != nil {
 		t.Fatalf("no error: %+v", err)
 	}
 
@@ -0,0 +1,102 @@
+package walmap
+
+import (
+	"math/rand/v2"
+)
+
+const (
+	skiplistMaxLevel int = 24
+)
+
+type skiplistNode struct {
+	key  string
+	next []*skiplistNode
+}
+
+// skiplist is the ordered set of keys behind ScanPrefix and Range, it is guarded by the mutex of its Log.
+type skiplist struct {
+	head  *skiplistNode
+	level int
+	size  int
+}
+
+func (s *skiplist) randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Uint32()&3 == 0 {
+		level += 1
+	}
+	return level
+}
+
+// findPrev fills update with the last node before key on each level and returns the node at key or after it.
+func (s *skiplist) findPrev(key string, update []*skiplistNode) *skiplistNode {
+	node := s.head
+	for i := s.level - 1; 0 <= i; i -= 1 {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		if update != nil {
+			update[i] = node
+		}
+	}
+	return node.next[0]
+}
+
+func (s *skiplist) Insert(key string) {
+	update := make([]*skiplistNode, skiplistMaxLevel)
+	if node := s.findPrev(key, update); node != nil && node.key == key {
+		return
+	}
+
+	level := s.randomLevel()
+	if s.level < level {
+		for i := s.level; i < level; i += 1 {
+			update[i] = s.head
+		}
+		s.level = level
+	}
+	node := &skiplistNode{key: key, next: make([]*skiplistNode, level)}
+	for i := 0; i < level; i += 1 {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	s.size += 1
+}
+
+func (s *skiplist) Remove(key string) {
+	update := make([]*skiplistNode, skiplistMaxLevel)
+	node := s.findPrev(key, update)
+	if node == nil || node.key != key {
+		return
+	}
+	for i := 0; i < s.level; i += 1 {
+		if update[i].next[i] != node {
+			break
+		}
+		update[i].next[i] = node.next[i]
+	}
+	for 1 < s.level && s.head.next[s.level-1] == nil {
+		s.level -= 1
+	}
+	s.size -= 1
+}
+
+func (s *skiplist) Len() int {
+	return s.size
+}
+
+// Ascend calls fn in order for every key from key (inclusive), until fn returns false.
+func (s *skiplist) Ascend(key string, fn func(key string) bool) {
+	for node := s.findPrev(key, nil); node != nil; node = node.next[0] {
+		if fn(node.key) != true {
+			return
+		}
+	}
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head:  &skiplistNode{next: make([]*skiplistNode, skiplistMaxLevel)},
+		level: 1,
+	}
+}
@@ -0,0 +1,58 @@
+package walmap
+
+import (
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestSkiplist(t *testing.T) {
+	s := newSkiplist()
+	expect := make(map[string]struct{})
+	for i := 0; i < 2000; i += 1 {
+		key := strconv.Itoa(rand.IntN(500))
+		if rand.IntN(3) == 0 {
+			s.Remove(key)
+			delete(expect, key)
+		} else {
+			s.Insert(key)
+			expect[key] = struct{}{}
+		}
+	}
+	keys := make([]string, 0, len(expect))
+	for key, _ := range expect {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if s.Len() != len(keys) {
+		t.Errorf("expect: %d actual: %d", len(keys), s.Len())
+	}
+	t.Run("ascend", func(tt *testing.T) {
+		actual := make([]string, 0, len(keys))
+		s.Ascend("", func(key string) bool {
+			actual = append(actual, key)
+			return true
+		})
+		if len(actual) != len(keys) {
+			tt.Fatalf("expect: %d actual: %d", len(keys), len(actual))
+		}
+		for i := range keys {
+			if actual[i] != keys[i] {
+				tt.Errorf("[%d] expect: %s actual: %s", i, keys[i], actual[i])
+			}
+		}
+	})
+	t.Run("seek", func(tt *testing.T) {
+		from := "25"
+		i := sort.SearchStrings(keys, from)
+		s.Ascend(from, func(key string) bool {
+			if key != keys[i] {
+				tt.Errorf("expect: %s actual: %s", keys[i], key)
+			}
+			i += 1
+			return i < len(keys) && i%10 != 0
+		})
+	})
+}
@@ -0,0 +1,129 @@
+package walmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/octu0/cmap"
+	"github.com/pkg/errors"
+)
+
+const (
+	// snapshotVersionLegacy is the headerless format written up to v1.1.1: shard size followed by shard logs
+	snapshotVersionLegacy uint16 = 0
+	snapshotVersion       uint16 = 1
+
+	snapshotMagicSize      int = 4
+	snapshotHeaderSize     int = snapshotMagicSize + 2 + 2 + 1 + 1 + 8 + 8
+	snapshotLegacyPeekSize int = 8
+
+	hashFuncProbe string = "walmap/hashfunc"
+)
+
+const (
+	snapshotFlagChecksum uint16 = 1 << 0 // records carry a CRC32C, required by decodeSnapshotHeader
+)
+
+const (
+	compressionNone uint8 = 0
+)
+
+var (
+	snapshotMagic = []byte("WMAP")
+)
+
+var (
+	ErrUnsupportedSnapshot = errors.New("unsupported snapshot")
+)
+
+type snapshotHeader struct {
+	Version     uint16
+	Flags       uint16
+	Compression uint8
+	ValueCodec  uint8
+	HashFuncID  uint64
+	ShardSize   uint64
+}
+
+func (h snapshotHeader) hasFlag(flag uint16) bool {
+	return h.Flags&flag != 0
+}
+
+// hashFuncID identifies a hash function by its output, so that custom functions can be told apart without registration.
+func hashFuncID(hashFunc cmap.CMapHashFunc) uint64 {
+	return hashFunc.Hash64(hashFuncProbe)
+}
+
+func newSnapshotHeader(s *shards) snapshotHeader {
+	return snapshotHeader{
+		Version:     snapshotVersion,
+		Flags:       snapshotFlagChecksum,
+		Compression: compressionNone,
+		ValueCodec:  s.valueCodecID,
+		HashFuncID:  hashFuncID(s.hash),
+		ShardSize:   s.size,
+	}
+}
+
+func encodeSnapshotHeader(w io.Writer, header snapshotHeader) error {
+	buf := make([]byte, snapshotHeaderSize)
+	copy(buf, snapshotMagic)
+	offset := snapshotMagicSize
+	binary.BigEndian.PutUint16(buf[offset:], header.Version)
+	offset += 2
+	binary.BigEndian.PutUint16(buf[offset:], header.Flags)
+	offset += 2
+	buf[offset] = header.Compression
+	offset += 1
+	buf[offset] = header.ValueCodec
+	offset += 1
+	binary.BigEndian.PutUint64(buf[offset:], header.HashFuncID)
+	offset += 8
+	binary.BigEndian.PutUint64(buf[offset:], header.ShardSize)
+
+	if _, err := w.Write(buf); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func decodeSnapshotHeader(r io.Reader) (snapshotHeader, error) {
+	buf := make([]byte, snapshotHeaderSize)
+	if _, err := io.ReadFull(r, buf[:snapshotLegacyPeekSize]); err != nil {
+		return snapshotHeader{}, errors.WithStack(err)
+	}
+	if bytes.Equal(buf[:snapshotMagicSize], snapshotMagic) != true {
+		// legacy snapshot starts with the bare shard size
+		return snapshotHeader{
+			Version:   snapshotVersionLegacy,
+			ShardSize: binary.BigEndian.Uint64(buf[:snapshotLegacyPeekSize]),
+		}, nil
+	}
+	if err := readFull(r, buf[snapshotLegacyPeekSize:]); err != nil {
+		return snapshotHeader{}, errors.WithStack(err)
+	}
+
+	header := snapshotHeader{}
+	offset := snapshotMagicSize
+	header.Version = binary.BigEndian.Uint16(buf[offset:])
+	offset += 2
+	header.Flags = binary.BigEndian.Uint16(buf[offset:])
+	offset += 2
+	header.Compression = buf[offset]
+	offset += 1
+	header.ValueCodec = buf[offset]
+	offset += 1
+	header.HashFuncID = binary.BigEndian.Uint64(buf[offset:])
+	offset += 8
+	header.ShardSize = binary.BigEndian.Uint64(buf[offset:])
+
+	if snapshotVersion < header.Version {
+		return snapshotHeader{}, errors.Wrapf(ErrUnsupportedSnapshot, "snapshot version %d is newer than supported version %d", header.Version, snapshotVersion)
+	}
+	if header.hasFlag(snapshotFlagChecksum) != true {
+		// every record is verified on restore, records without checksum cannot be read
+		return snapshotHeader{}, errors.Wrap(ErrUnsupportedSnapshot, "snapshot records have no checksum")
+	}
+	return header, nil
+}
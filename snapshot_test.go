@@ -0,0 +1,368 @@
+package walmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	"github.com/octu0/walmap/codec"
+	"github.com/pkg/errors"
+)
+
+func TestSnapshotHeader(t *testing.T) {
+	t.Run("roundtrip", func(tt *testing.T) {
+		s := newShards(newDefaultOption())
+		header := newSnapshotHeader(s)
+
+		out := bytes.NewBuffer(nil)
+		if err := encodeSnapshotHeader(out, header); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if out.Len() != snapshotHeaderSize {
+			tt.Errorf("actual: %d", out.Len())
+		}
+		if bytes.HasPrefix(out.Bytes(), snapshotMagic) != true {
+			tt.Errorf("magic: %v", out.Bytes()[:snapshotMagicSize])
+		}
+
+		decoded, err := decodeSnapshotHeader(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if decoded != header {
+			tt.Errorf("expect: %+v actual: %+v", header, decoded)
+		}
+		if decoded.hasFlag(snapshotFlagChecksum) != true {
+			tt.Errorf("checksum flag")
+		}
+		if decoded.ShardSize != uint64(defaultShardSize) {
+			tt.Errorf("actual: %d", decoded.ShardSize)
+		}
+	})
+	t.Run("newer", func(tt *testing.T) {
+		header := newSnapshotHeader(newShards(newDefaultOption()))
+		header.Version = snapshotVersion + 1
+
+		out := bytes.NewBuffer(nil)
+		if err := encodeSnapshotHeader(out, header); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if _, err := Restore(bytes.NewReader(out.Bytes())); errors.Is(err, ErrUnsupportedSnapshot) != true {
+			tt.Errorf("unsupported version: %+v", err)
+		}
+	})
+	t.Run("compression", func(tt *testing.T) {
+		header := newSnapshotHeader(newShards(newDefaultOption()))
+		header.Compression = 0xff
+
+		out := bytes.NewBuffer(nil)
+		if err := encodeSnapshotHeader(out, header); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if _, err := Restore(bytes.NewReader(out.Bytes())); errors.Is(err, ErrUnsupportedSnapshot) != true {
+			tt.Errorf("unsupported compression: %+v", err)
+		}
+	})
+	t.Run("checksum", func(tt *testing.T) {
+		header := newSnapshotHeader(newShards(newDefaultOption()))
+		header.Flags &^= snapshotFlagChecksum
+
+		out := bytes.NewBuffer(nil)
+		if err := encodeSnapshotHeader(out, header); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if _, err := Restore(bytes.NewReader(out.Bytes())); errors.Is(err, ErrUnsupportedSnapshot) != true {
+			tt.Errorf("without checksum: %+v", err)
+		}
+	})
+}
+
+func TestSnapshotConcurrentWrite(t *testing.T) {
+	m := New(WithShardSize(4))
+	for i := 0; i < 1000; i += 1 {
+		m.Set("key"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i += 1 {
+			m.Set("new"+strconv.Itoa(i), strconv.Itoa(i))
+			if i%100 == 0 {
+				if err := m.Compact(); err != nil {
+					t.Errorf("no error: %+v", err)
+				}
+			}
+		}
+	}()
+
+	out := bytes.NewBuffer(nil)
+	if err := m.Snapshot(out); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	wg.Wait()
+
+	r, err := Restore(out, WithShardSize(4))
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	for i := 0; i < 1000; i += 1 {
+		if v, ok := r.Get("key" + strconv.Itoa(i)); ok != true || v.(string) != strconv.Itoa(i) {
+			t.Errorf("key%d actual: %v %v", i, v, ok)
+		}
+	}
+}
+
+func TestSnapshotConsistent(t *testing.T) {
+	m := NewMap[int](JSONCodec[int](), WithShardSize(8), WithConsistentSnapshot())
+	keyA, keyB := "a", "b"
+	for i := 0; m.s.Load().GetShard(keyA) == m.s.Load().GetShard(keyB); i += 1 {
+		keyB = "b" + strconv.Itoa(i)
+	}
+	m.Set(keyA, 0)
+	m.Set(keyB, 0)
+
+	done := make(chan struct{})
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// keyA is always updated before keyB, so keyB never gets ahead of keyA at any instant
+		for i := 1; i < 10000; i += 1 {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			m.Set(keyA, i)
+			m.Set(keyB, i)
+		}
+	}()
+
+	for i := 0; i < 20; i += 1 {
+		out := bytes.NewBuffer(nil)
+		if err := m.Snapshot(out); err != nil {
+			t.Fatalf("no error: %+v", err)
+		}
+		r, err := RestoreMap[int](out, JSONCodec[int](), WithShardSize(8))
+		if err != nil {
+			t.Fatalf("no error: %+v", err)
+		}
+		a, _ := r.Get(keyA)
+		b, _ := r.Get(keyB)
+		if a < b || 1 < a-b {
+			t.Errorf("inconsistent snapshot: %s=%d %s=%d", keyA, a, keyB, b)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestRestoreShortRead(t *testing.T) {
+	m := New(WithShardSize(4))
+	for i := 0; i < 100; i += 1 {
+		m.Set("key"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	out := bytes.NewBuffer(nil)
+	if err := m.Snapshot(out); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+
+	t.Run("one byte reader", func(tt *testing.T) {
+		r, err := Restore(iotest.OneByteReader(bytes.NewReader(out.Bytes())), WithShardSize(4))
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		for i := 0; i < 100; i += 1 {
+			if v, ok := r.Get("key" + strconv.Itoa(i)); ok != true || v.(string) != strconv.Itoa(i) {
+				tt.Errorf("key%d actual: %v %v", i, v, ok)
+			}
+		}
+	})
+	t.Run("truncated", func(tt *testing.T) {
+		for _, size := range []int{snapshotHeaderSize - 1, snapshotHeaderSize + 4, out.Len() - 1} {
+			_, err := Restore(iotest.OneByteReader(bytes.NewReader(out.Bytes()[:size])), WithShardSize(4))
+			if errors.Is(err, io.ErrUnexpectedEOF) != true {
+				tt.Errorf("size=%d actual: %+v", size, err)
+			}
+		}
+	})
+	t.Run("damaged block size", func(tt *testing.T) {
+		tests := map[int]error{
+			snapshotHeaderSize:     codec.ErrCorruptRecord,
+			snapshotHeaderSize + 3: io.ErrUnexpectedEOF,
+		}
+		for offset, expect := range tests {
+			damaged := bytes.Clone(out.Bytes())
+			damaged[offset] ^= 0xff
+			if _, err := Restore(bytes.NewReader(damaged), WithShardSize(4)); errors.Is(err, expect) != true {
+				tt.Errorf("offset=%d actual: %+v", offset, err)
+			}
+		}
+	})
+}
+
+func TestRestoreLegacySnapshot(t *testing.T) {
+	encodeLegacy := func(t *testing.T, w *bytes.Buffer, key string, value interface{}) {
+		data := bytes.NewBuffer(nil)
+		if err := gob.NewEncoder(data).Encode(item{value}); err != nil {
+			t.Fatalf("no error: %+v", err)
+		}
+		binary.Write(w, binary.BigEndian, uint64(len(key)))
+		binary.Write(w, binary.BigEndian, uint64(data.Len()))
+		w.WriteString(key)
+		w.Write(data.Bytes())
+	}
+
+	shard := bytes.NewBuffer(nil)
+	encodeLegacy(t, shard, "foo", "bar")
+	encodeLegacy(t, shard, "hello", "world")
+	encodeLegacy(t, shard, "hello", "world2")
+
+	out := bytes.NewBuffer(nil)
+	binary.Write(out, binary.BigEndian, uint64(1))
+	binary.Write(out, binary.BigEndian, uint64(shard.Len()))
+	out.Write(shard.Bytes())
+
+	m, err := Restore(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	if m.Len() != 2 {
+		t.Errorf("actual: %d", m.Len())
+	}
+	if v, ok := m.Get("foo"); ok != true {
+		t.Errorf("exists")
+	} else if v.(string) != "bar" {
+		t.Errorf("actual: %v", v)
+	}
+	if v, ok := m.Get("hello"); ok != true {
+		t.Errorf("exists")
+	} else if v.(string) != "world2" {
+		t.Errorf("actual: %v", v)
+	}
+
+	// migrated snapshot is written in the current format
+	migrated := bytes.NewBuffer(nil)
+	if err := m.Snapshot(migrated); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	if bytes.HasPrefix(migrated.Bytes(), snapshotMagic) != true {
+		t.Errorf("magic: %v", migrated.Bytes()[:snapshotMagicSize])
+	}
+}
+
+type testFNVHashFunc struct{}
+
+func (testFNVHashFunc) Hash64(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+func TestRestoreHashFunc(t *testing.T) {
+	m1 := New(WithShardSize(16))
+	for i := 0; i < 100; i += 1 {
+		m1.Set(strconv.Itoa(i), i)
+	}
+	out := bytes.NewBuffer(nil)
+	if err := m1.Snapshot(out); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+
+	t.Run("same", func(tt *testing.T) {
+		if _, err := Restore(bytes.NewReader(out.Bytes())); err != nil {
+			tt.Errorf("no error: %+v", err)
+		}
+	})
+	t.Run("mismatch", func(tt *testing.T) {
+		_, err := Restore(bytes.NewReader(out.Bytes()), WithHashFunc(testFNVHashFunc{}))
+		if errors.Is(err, ErrHashFuncMismatch) != true {
+			tt.Errorf("hash func mismatch: %+v", err)
+		}
+	})
+	t.Run("rebalance", func(tt *testing.T) {
+		m2, err := Restore(bytes.NewReader(out.Bytes()), WithHashFunc(testFNVHashFunc{}), WithRebalance())
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if m2.Len() != 100 {
+			tt.Errorf("actual: %d", m2.Len())
+		}
+		for i := 0; i < 100; i += 1 {
+			v, ok := m2.Get(strconv.Itoa(i))
+			if ok != true {
+				tt.Errorf("exists key: %d", i)
+				continue
+			}
+			if v.(int) != i {
+				tt.Errorf("actual: %v", v)
+			}
+		}
+
+		out2 := bytes.NewBuffer(nil)
+		if err := m2.Snapshot(out2); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if _, err := Restore(bytes.NewReader(out2.Bytes()), WithHashFunc(testFNVHashFunc{})); err != nil {
+			tt.Errorf("no error: %+v", err)
+		}
+	})
+}
+
+func TestRestoreReshard(t *testing.T) {
+	m1 := New(WithShardSize(16))
+	for i := 0; i < 1000; i += 1 {
+		m1.Set(strconv.Itoa(i), i)
+	}
+	m1.Remove("10")
+	out := bytes.NewBuffer(nil)
+	if err := m1.Snapshot(out); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+
+	for _, size := range []int{1, 16, 64} {
+		m2, err := Restore(bytes.NewReader(out.Bytes()), WithShardSize(size))
+		if err != nil {
+			t.Fatalf("no error: %+v", err)
+		}
+		if n := len(m2.s.Load().Shards()); n != size {
+			t.Errorf("shard size actual: %d", n)
+		}
+		if m2.Len() != 999 {
+			t.Errorf("actual: %d", m2.Len())
+		}
+		if _, ok := m2.Get("10"); ok {
+			t.Errorf("removed key")
+		}
+		for i := 0; i < 1000; i += 1 {
+			if i == 10 {
+				continue
+			}
+			v, ok := m2.Get(strconv.Itoa(i))
+			if ok != true {
+				t.Errorf("exists key: %d", i)
+				continue
+			}
+			if v.(int) != i {
+				t.Errorf("actual: %v", v)
+			}
+		}
+	}
+
+	// without WithShardSize, the shard size of the snapshot is kept
+	m3, err := Restore(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	if n := len(m3.s.Load().Shards()); n != 16 {
+		t.Errorf("shard size actual: %d", n)
+	}
+}
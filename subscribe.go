@@ -0,0 +1,269 @@
+package walmap
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/octu0/walmap/codec"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultSubscriptionBuffer int = 1024
+)
+
+var (
+	// ErrLagged reports a subscriber that fell behind or lost track of the shards (Compact before resuming, Reshard),
+	// it has to resync from a snapshot.
+	ErrLagged = errors.New("subscriber lagged, resync from snapshot")
+	// ErrInvalidSubscriptionBuffer ends a subscription at once when WithSubscriptionBuffer is below 1.
+	ErrInvalidSubscriptionBuffer = errors.New("subscription buffer must be at least 1")
+)
+
+// Event is a mutation appended to a shard's log.
+type Event struct {
+	Shard      int
+	Generation uint64 // generation of the shard's log, see SnapshotToken
+	Offset     uint64 // offset of the record in the shard's log
+	Key        string
+	Data       []byte // encoded value, nil for a tombstone
+	Tombstone  bool
+	Record     []byte    // the whole encoded record (header, key and data), Data points into it. must not be modified
+	Time       time.Time // when the record was appended, or replayed for the backlog of Subscribe
+}
+
+// Subscription receives the events of a map, see Map.Subscribe.
+type Subscription struct {
+	mutex  *sync.Mutex
+	events chan Event
+	active []bool // events of a shard are sent once its backlog has been replayed
+	err    error
+	closed bool
+	remove func(*Subscription)
+}
+
+// Events is closed when the subscription ends, Err tells why.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Err returns ErrLagged when the subscriber fell behind, nil when it was closed by Close.
+func (s *Subscription) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.err
+}
+
+func (s *Subscription) Close() {
+	s.remove(s)
+	s.end(nil)
+}
+
+func (s *Subscription) end(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.err = err
+	close(s.events)
+}
+
+// send never blocks the writer: a subscriber whose buffer is full is ended with ErrLagged.
+func (s *Subscription) send(ev Event, replay bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return false
+	}
+	if ev.Shard < 0 || len(s.active) <= ev.Shard {
+		// a shard this subscription does not know, the shards were replaced
+		s.closed = true
+		s.err = errors.Wrapf(ErrLagged, "unknown shard %d", ev.Shard)
+		close(s.events)
+		return false
+	}
+	if replay != true && s.active[ev.Shard] != true {
+		// covered by the replay of the shard's backlog
+		return true
+	}
+	select {
+	case s.events <- ev:
+		return true
+	default:
+	}
+	s.closed = true
+	s.err = errors.WithStack(ErrLagged)
+	close(s.events)
+	return false
+}
+
+func (s *Subscription) activate(shard int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.active[shard] = true
+}
+
+type subscribers struct {
+	mutex *sync.Mutex
+	subs  map[*Subscription]struct{}
+	count *atomic.Int64 // len(subs), read by the writers without taking mutex
+}
+
+func (b *subscribers) add(sub *Subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.subs[sub] = struct{}{}
+	b.count.Store(int64(len(b.subs)))
+}
+
+func (b *subscribers) remove(sub *Subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.subs, sub)
+	b.count.Store(int64(len(b.subs)))
+}
+
+func (b *subscribers) publish(ev Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for sub := range b.subs {
+		if sub.send(ev, false) != true {
+			delete(b.subs, sub)
+		}
+	}
+	b.count.Store(int64(len(b.subs)))
+}
+
+// endAll ends every subscription with err, e.g. ErrLagged when the shards are replaced.
+func (b *subscribers) endAll(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for sub := range b.subs {
+		sub.end(err)
+		delete(b.subs, sub)
+	}
+	b.count.Store(0)
+}
+
+// watch makes the logs of s publish their records to the subscribers.
+// without subscribers a write only loads count, so the shards are not serialized on mutex.
+func (b *subscribers) watch(s *shards) {
+	for i, cache := range s.caches {
+		shard := i
+		cache.log.setNotify(func(generation uint64, index codec.Index, record []byte) {
+			if b.count.Load() == 0 {
+				return
+			}
+			ev, err := newEvent(shard, generation, uint64(index), record)
+			if err != nil {
+				return
+			}
+			b.publish(ev)
+		})
+	}
+}
+
+func newEvent(shard int, generation uint64, offset uint64, record []byte) (Event, error) {
+	header, key, data, err := codec.DecodeView(record)
+	if err != nil {
+		return Event{}, errors.WithStack(err)
+	}
+	ev := Event{
+		Shard:      shard,
+		Generation: generation,
+		Offset:     offset,
+		Key:        string(key),
+		Tombstone:  header.IsTombstone(),
+		Record:     record,
+		Time:       time.Now(),
+	}
+	if header.IsTombstone() != true {
+		ev.Data = data
+	}
+	return ev, nil
+}
+
+// subscribe registers a subscription whose events start right after since, the records appended since are replayed first.
+// a shard missing from since (zero token) starts from its current end.
+func (b *subscribers) subscribe(s *shards, since SnapshotToken, bufferSize int) *Subscription {
+	if bufferSize < 1 {
+		sub := &Subscription{
+			mutex:  new(sync.Mutex),
+			events: make(chan Event),
+			remove: b.remove,
+		}
+		sub.end(errors.Wrapf(ErrInvalidSubscriptionBuffer, "buffer size %d", bufferSize))
+		return sub
+	}
+
+	sub := &Subscription{
+		mutex:  new(sync.Mutex),
+		events: make(chan Event, bufferSize),
+		active: make([]bool, len(s.caches)),
+		remove: b.remove,
+	}
+	b.add(sub)
+
+	known := len(since.positions) == len(s.caches)
+	for i, cache := range s.caches {
+		if err := b.replay(sub, i, cache.log, since, known); err != nil {
+			b.remove(sub)
+			sub.end(err)
+			return sub
+		}
+	}
+	return sub
+}
+
+// replay sends the backlog of a shard and activates it, holding the log's read lock so that no record is published meanwhile.
+func (b *subscribers) replay(sub *Subscription, shard int, log *Log, since SnapshotToken, known bool) error {
+	log.mutex.RLock()
+	defer log.mutex.RUnlock()
+
+	if known != true {
+		sub.activate(shard)
+		return nil
+	}
+	pos := since.positions[shard]
+	buf := log.buf.Bytes()
+	if pos.generation != log.generation || uint64(len(buf)) < pos.offset {
+		return errors.Wrapf(ErrLagged, "shard %d compacted since the token", shard)
+	}
+
+	offset := pos.offset
+	for offset < uint64(len(buf)) {
+		size, err := recordSizeAt(buf, codec.Index(offset))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		ev, err := newEvent(shard, log.generation, offset, buf[offset:offset+size])
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if sub.send(ev, true) != true {
+			return errors.Wrapf(ErrLagged, "shard %d backlog exceeds the buffer", shard)
+		}
+		offset += size
+	}
+	sub.activate(shard)
+	return nil
+}
+
+func newSubscribers() *subscribers {
+	return &subscribers{
+		mutex: new(sync.Mutex),
+		subs:  make(map[*Subscription]struct{}),
+		count: new(atomic.Int64),
+	}
+}
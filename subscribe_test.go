@@ -0,0 +1,237 @@
+package walmap
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func testReceive(t *testing.T, sub *Subscription, n int) []Event {
+	events := make([]Event, 0, n)
+	timeout := time.After(time.Second)
+	for len(events) < n {
+		select {
+		case ev, ok := <-sub.Events():
+			if ok != true {
+				t.Fatalf("closed after %d events: %+v", len(events), sub.Err())
+			}
+			events = append(events, ev)
+		case <-timeout:
+			t.Fatalf("received %d events, expect %d", len(events), n)
+		}
+	}
+	return events
+}
+
+func TestSubscribe(t *testing.T) {
+	t.Run("events", func(tt *testing.T) {
+		m := NewMap[string](StringCodec(), WithShardSize(4))
+		defer m.Close()
+
+		sub := m.Subscribe(SnapshotToken{})
+		m.Set("a", "1")
+		m.Set("a", "2")
+		m.Remove("a")
+
+		events := testReceive(tt, sub, 3)
+		if events[0].Key != "a" || string(events[0].Data) != "1" || events[0].Tombstone {
+			tt.Errorf("actual: %+v", events[0])
+		}
+		if string(events[1].Data) != "2" || events[1].Offset <= events[0].Offset {
+			tt.Errorf("actual: %+v", events[1])
+		}
+		if events[2].Tombstone != true || events[2].Data != nil {
+			tt.Errorf("actual: %+v", events[2])
+		}
+		if events[0].Shard != events[2].Shard || events[0].Generation != events[2].Generation {
+			tt.Errorf("same shard: %+v %+v", events[0], events[2])
+		}
+	})
+	t.Run("since", func(tt *testing.T) {
+		m := NewMap[string](StringCodec(), WithShardSize(4))
+		defer m.Close()
+
+		m.Set("before", "snapshot")
+		token, err := m.SnapshotSince(bytes.NewBuffer(nil), SnapshotToken{})
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		for i := 0; i < 10; i += 1 {
+			m.Set("key"+strconv.Itoa(i), strconv.Itoa(i))
+		}
+
+		sub := m.Subscribe(token)
+		m.Set("after", "subscribe")
+
+		events := testReceive(tt, sub, 11)
+		keys := map[string]bool{}
+		for _, ev := range events {
+			keys[ev.Key] = true
+		}
+		if keys["before"] {
+			tt.Errorf("records of the snapshot must not be replayed")
+		}
+		if len(keys) != 11 || keys["after"] != true {
+			tt.Errorf("actual: %v", keys)
+		}
+	})
+	t.Run("concurrent", func(tt *testing.T) {
+		m := NewMap[string](StringCodec(), WithShardSize(4), WithSubscriptionBuffer(10000))
+		defer m.Close()
+
+		token, err := m.SnapshotSince(bytes.NewBuffer(nil), SnapshotToken{})
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 2000; i += 1 {
+				m.Set("key"+strconv.Itoa(i%100), strconv.Itoa(i))
+			}
+		}()
+		// subscribes while writing, the replayed backlog and the live events must join without gap nor duplicate
+		time.Sleep(time.Millisecond)
+		sub := m.Subscribe(token)
+		<-done
+
+		events := testReceive(tt, sub, 2000)
+		next := map[int]uint64{}
+		for _, ev := range events {
+			if offset := next[ev.Shard]; ev.Offset != offset {
+				tt.Fatalf("shard %d expect offset %d actual %d", ev.Shard, offset, ev.Offset)
+			}
+			next[ev.Shard] = ev.Offset + uint64(len(ev.Record))
+		}
+	})
+	t.Run("lagged", func(tt *testing.T) {
+		m := NewMap[string](StringCodec(), WithShardSize(4), WithSubscriptionBuffer(2))
+		defer m.Close()
+
+		sub := m.Subscribe(SnapshotToken{})
+		for i := 0; i < 10; i += 1 {
+			m.Set("key"+strconv.Itoa(i), "v")
+		}
+		count := 0
+		for range sub.Events() {
+			count += 1
+		}
+		if count != 2 {
+			tt.Errorf("actual: %d", count)
+		}
+		if errors.Is(sub.Err(), ErrLagged) != true {
+			tt.Errorf("actual: %+v", sub.Err())
+		}
+	})
+	t.Run("compacted", func(tt *testing.T) {
+		m := NewMap[string](StringCodec(), WithShardSize(1))
+		defer m.Close()
+
+		m.Set("a", "1")
+		token, err := m.SnapshotSince(bytes.NewBuffer(nil), SnapshotToken{})
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		m.Set("a", "2")
+		if err := m.Compact(); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+
+		sub := m.Subscribe(token)
+		if _, ok := <-sub.Events(); ok {
+			tt.Errorf("must be closed")
+		}
+		if errors.Is(sub.Err(), ErrLagged) != true {
+			tt.Errorf("actual: %+v", sub.Err())
+		}
+	})
+	t.Run("reshard", func(tt *testing.T) {
+		m := NewMap[string](StringCodec(), WithShardSize(4))
+		defer m.Close()
+
+		sub := m.Subscribe(SnapshotToken{})
+		if err := m.Reshard(8); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if _, ok := <-sub.Events(); ok {
+			tt.Errorf("must be closed")
+		}
+		if errors.Is(sub.Err(), ErrLagged) != true {
+			tt.Errorf("actual: %+v", sub.Err())
+		}
+
+		// new subscriptions follow the new shards
+		sub2 := m.Subscribe(SnapshotToken{})
+		m.Set("a", "1")
+		testReceive(tt, sub2, 1)
+	})
+	t.Run("close", func(tt *testing.T) {
+		m := NewMap[string](StringCodec(), WithShardSize(4))
+
+		sub1 := m.Subscribe(SnapshotToken{})
+		sub2 := m.Subscribe(SnapshotToken{})
+		sub1.Close()
+		m.Set("a", "1")
+		testReceive(tt, sub2, 1)
+
+		if err := m.Close(); err != nil {
+			tt.Errorf("no error: %+v", err)
+		}
+		for _, sub := range []*Subscription{sub1, sub2} {
+			if _, ok := <-sub.Events(); ok {
+				tt.Errorf("must be closed")
+			}
+			if sub.Err() != nil {
+				tt.Errorf("actual: %+v", sub.Err())
+			}
+		}
+	})
+}
+
+func TestSubscriptionUnknownShard(t *testing.T) {
+	m := New(WithShardSize(2))
+	defer m.Close()
+
+	sub := m.Subscribe(SnapshotToken{})
+	if n := m.subs.count.Load(); n != 1 {
+		t.Errorf("actual: %d", n)
+	}
+	// an event of a shard added by Reshard after the subscription started
+	if sub.send(Event{Shard: 2}, false) {
+		t.Errorf("unknown shard sent")
+	}
+	if _, ok := <-sub.Events(); ok {
+		t.Errorf("ended")
+	}
+	if errors.Is(sub.Err(), ErrLagged) != true {
+		t.Errorf("lagged: %+v", sub.Err())
+	}
+
+	// the writer drops it from the subscribers
+	m.Set("foo", "bar")
+	if n := m.subs.count.Load(); n != 0 {
+		t.Errorf("actual: %d", n)
+	}
+}
+
+func TestSubscriptionBufferInvalid(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		m := New(WithShardSize(2), WithSubscriptionBuffer(size))
+		sub := m.Subscribe(SnapshotToken{})
+		if _, ok := <-sub.Events(); ok {
+			t.Errorf("size=%d ended", size)
+		}
+		if errors.Is(sub.Err(), ErrInvalidSubscriptionBuffer) != true {
+			t.Errorf("size=%d actual: %+v", size, sub.Err())
+		}
+		sub.Close()
+		m.Set("foo", "bar")
+		if n := m.subs.count.Load(); n != 0 {
+			t.Errorf("size=%d subscribers: %d", size, n)
+		}
+		m.Close()
+	}
+}
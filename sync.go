@@ -0,0 +1,45 @@
+package walmap
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type syncMode uint8
+
+const (
+	syncModeNone syncMode = iota
+	syncModeAlways
+	syncModeInterval
+)
+
+// SyncPolicy decides when the segment files of a map opened by Open are fsync'ed.
+type SyncPolicy struct {
+	mode     syncMode
+	interval time.Duration
+}
+
+var (
+	ErrInvalidSyncInterval = errors.New("sync interval must be positive")
+)
+
+var (
+	// SyncNone leaves flushing to the OS.
+	SyncNone = SyncPolicy{mode: syncModeNone}
+	// SyncAlways fsyncs the segment file on every mutation.
+	SyncAlways = SyncPolicy{mode: syncModeAlways}
+)
+
+// SyncInterval fsyncs all modified segment files every interval (group commit).
+// interval must be positive, Open fails with ErrInvalidSyncInterval otherwise.
+func SyncInterval(interval time.Duration) SyncPolicy {
+	return SyncPolicy{mode: syncModeInterval, interval: interval}
+}
+
+func (p SyncPolicy) validate() error {
+	if p.mode == syncModeInterval && p.interval <= 0 {
+		return errors.Wrapf(ErrInvalidSyncInterval, "interval %s", p.interval)
+	}
+	return nil
+}
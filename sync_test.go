@@ -0,0 +1,393 @@
+package walmap
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func testDirtyShards(m *WALMap) int {
+	count := 0
+	for _, c := range m.s.Load().Shards() {
+		c.log.mutex.RLock()
+		if c.log.dirty() {
+			count += 1
+		}
+		c.log.mutex.RUnlock()
+	}
+	return count
+}
+
+func TestSyncPolicy(t *testing.T) {
+	t.Run("none", func(tt *testing.T) {
+		m, err := Open(tt.TempDir(), WithShardSize(4), WithSyncPolicy(SyncNone))
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		defer m.Close()
+
+		m.Set("foo", "bar")
+		if n := testDirtyShards(m); n != 1 {
+			tt.Errorf("actual: %d", n)
+		}
+		if err := m.Sync(); err != nil {
+			tt.Errorf("no error: %+v", err)
+		}
+		if n := testDirtyShards(m); n != 0 {
+			tt.Errorf("actual: %d", n)
+		}
+	})
+	t.Run("always", func(tt *testing.T) {
+		m, err := Open(tt.TempDir(), WithShardSize(4), WithSyncPolicy(SyncAlways))
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		defer m.Close()
+
+		m.Set("foo", "bar")
+		m.Set("hello", "world")
+		m.Remove("hello")
+		if n := testDirtyShards(m); n != 0 {
+			tt.Errorf("actual: %d", n)
+		}
+	})
+	t.Run("interval", func(tt *testing.T) {
+		m, err := Open(tt.TempDir(), WithShardSize(4), WithSyncPolicy(SyncInterval(10*time.Millisecond)))
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		defer m.Close()
+
+		m.Set("foo", "bar")
+		m.Set("hello", "world")
+
+		deadline := time.Now().Add(time.Second)
+		for 0 < testDirtyShards(m) {
+			if deadline.Before(time.Now()) {
+				tt.Fatalf("not synced")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
+
+func TestSetSyncRemoveSync(t *testing.T) {
+	dir := t.TempDir()
+	m1, err := Open(dir, WithShardSize(4))
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	if err := m1.SetSync("foo", "bar"); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if err := m1.SetSync("hello", "world"); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if n := testDirtyShards(m1); n != 0 {
+		t.Errorf("actual: %d", n)
+	}
+
+	v, ok, err := m1.RemoveSync("hello")
+	if err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if ok != true {
+		t.Errorf("removed")
+	}
+	if v.(string) != "world" {
+		t.Errorf("actual: %v", v)
+	}
+	if _, ok, err := m1.RemoveSync("hello"); err != nil {
+		t.Errorf("no error: %+v", err)
+	} else if ok {
+		t.Errorf("already removed")
+	}
+	if n := testDirtyShards(m1); n != 0 {
+		t.Errorf("actual: %d", n)
+	}
+	if err := m1.Close(); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+
+	m2, err := Open(dir, WithShardSize(4))
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	defer m2.Close()
+
+	if m2.Len() != 1 {
+		t.Errorf("actual: %d", m2.Len())
+	}
+	if v, ok := m2.Get("foo"); ok != true {
+		t.Errorf("exists")
+	} else if v.(string) != "bar" {
+		t.Errorf("actual: %v", v)
+	}
+}
+
+// testHoldSync makes the first sync block until the returned release is called, started is closed once it is blocked.
+func testHoldSync(t *testing.T) (started chan struct{}, release func(), calls *atomic.Int64) {
+	started = make(chan struct{})
+	hold := make(chan struct{})
+	calls = new(atomic.Int64)
+	orig := syncFile
+	syncFile = func(f *os.File) error {
+		if calls.Add(1) == 1 {
+			close(started)
+			<-hold
+		}
+		return orig(f)
+	}
+	once := new(sync.Once)
+	release = func() {
+		once.Do(func() { close(hold) })
+	}
+	t.Cleanup(func() {
+		release()
+		syncFile = orig
+	})
+	return started, release, calls
+}
+
+func TestSyncInFlight(t *testing.T) {
+	t.Run("sync", func(tt *testing.T) {
+		log, err := OpenLog(filepath.Join(tt.TempDir(), "test.wal"), 10, 10)
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		defer log.Close()
+
+		started, release, calls := testHoldSync(tt)
+		if err := log.Write("foo", []byte("bar")); err != nil {
+			tt.Errorf("no error: %+v", err)
+		}
+		done := make(chan error)
+		go func() { done <- log.Sync() }()
+		<-started
+
+		// the first sync is still in flight, this one must not return before the write is on disk
+		if err := log.Sync(); err != nil {
+			tt.Errorf("no error: %+v", err)
+		}
+		if n := calls.Load(); n != 2 {
+			tt.Errorf("returned before sync, calls: %d", n)
+		}
+		release()
+		if err := <-done; err != nil {
+			tt.Errorf("no error: %+v", err)
+		}
+		if log.dirty() {
+			tt.Errorf("synced")
+		}
+	})
+	t.Run("close", func(tt *testing.T) {
+		log, err := OpenLog(filepath.Join(tt.TempDir(), "test.wal"), 10, 10)
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+
+		started, release, calls := testHoldSync(tt)
+		if err := log.Write("foo", []byte("bar")); err != nil {
+			tt.Errorf("no error: %+v", err)
+		}
+		done := make(chan error)
+		go func() { done <- log.Sync() }()
+		<-started
+
+		if err := log.Close(); err != nil {
+			tt.Errorf("no error: %+v", err)
+		}
+		if n := calls.Load(); n != 2 {
+			tt.Errorf("closed without sync, calls: %d", n)
+		}
+		release()
+		// the file was closed under it, but Close synced it
+		if err := <-done; err != nil {
+			tt.Errorf("no error: %+v", err)
+		}
+	})
+}
+
+func TestSetSyncIntervalSyncer(t *testing.T) {
+	dir := t.TempDir()
+	m1, err := Open(dir, WithShardSize(1), WithSyncPolicy(SyncInterval(time.Millisecond)))
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+
+	started, release, calls := testHoldSync(t)
+	m1.Set("foo", "bar")
+	// the interval syncer holds the first sync
+	<-started
+
+	if err := m1.SetSync("hello", "world"); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+	if n := calls.Load(); n < 2 {
+		t.Errorf("returned before sync, calls: %d", n)
+	}
+	release()
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 4; i += 1 {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j += 1 {
+				if err := m1.SetSync("key"+strconv.Itoa(i*50+j), j); err != nil {
+					t.Errorf("no error: %+v", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := m1.Close(); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+
+	m2, err := Open(dir, WithShardSize(1))
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	defer m2.Close()
+
+	if m2.Len() != 202 {
+		t.Errorf("actual: %d", m2.Len())
+	}
+}
+
+func TestSyncAlwaysFailure(t *testing.T) {
+	dir := t.TempDir()
+	m1, err := Open(dir, WithShardSize(1), WithSyncPolicy(SyncAlways))
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	m1.Set("foo", "bar")
+
+	orig := syncFile
+	syncFile = func(f *os.File) error {
+		return os.ErrInvalid
+	}
+	if err := m1.SetSync("failed", "value"); err == nil {
+		t.Errorf("sync error")
+	}
+	syncFile = orig
+
+	// the failed record is dropped, the next one does not point at it
+	m1.Set("hello", "world")
+	if _, ok := m1.Get("failed"); ok {
+		t.Errorf("failed record")
+	}
+	if v, ok := m1.Get("hello"); ok != true || v.(string) != "world" {
+		t.Errorf("actual: %v %v", v, ok)
+	}
+	if err := m1.Close(); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+
+	m2, err := Open(dir, WithShardSize(1))
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	defer m2.Close()
+
+	if m2.Len() != 2 {
+		t.Errorf("actual: %d", m2.Len())
+	}
+	if v, ok := m2.Get("hello"); ok != true || v.(string) != "world" {
+		t.Errorf("actual: %v %v", v, ok)
+	}
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	t.Run("Open", func(tt *testing.T) {
+		dir := tt.TempDir()
+		m1, err := Open(dir, WithShardSize(2))
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if err := m1.SetE("a", "1"); err != nil {
+			tt.Errorf("no error: %+v", err)
+		}
+		if err := m1.Close(); err != nil {
+			tt.Errorf("no error: %+v", err)
+		}
+
+		if err := m1.SetE("b", "2"); errors.Is(err, ErrClosed) != true {
+			tt.Errorf("SetE: %+v", err)
+		}
+		if err := m1.SetSync("c", "3"); errors.Is(err, ErrClosed) != true {
+			tt.Errorf("SetSync: %+v", err)
+		}
+		if _, _, err := m1.RemoveE("a"); errors.Is(err, ErrClosed) != true {
+			tt.Errorf("RemoveE: %+v", err)
+		}
+		if _, _, err := m1.RemoveSync("a"); errors.Is(err, ErrClosed) != true {
+			tt.Errorf("RemoveSync: %+v", err)
+		}
+
+		m2, err := Open(dir, WithShardSize(2))
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		defer m2.Close()
+
+		if m2.Len() != 1 {
+			tt.Errorf("actual: %d", m2.Len())
+		}
+		if v, ok := m2.Get("a"); ok != true || v.(string) != "1" {
+			tt.Errorf("actual: %v %v", v, ok)
+		}
+	})
+	t.Run("New", func(tt *testing.T) {
+		m := New(WithShardSize(2))
+		m.Set("a", "1")
+		if err := m.Close(); err != nil {
+			tt.Errorf("no error: %+v", err)
+		}
+		if err := m.SetE("b", "2"); errors.Is(err, ErrClosed) != true {
+			tt.Errorf("SetE: %+v", err)
+		}
+		if v, ok := m.Get("a"); ok != true || v.(string) != "1" {
+			tt.Errorf("readable after close: %v %v", v, ok)
+		}
+	})
+}
+
+func TestSyncIntervalInvalid(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Second} {
+		m, err := Open(t.TempDir(), WithSyncPolicy(SyncInterval(interval)))
+		if errors.Is(err, ErrInvalidSyncInterval) != true {
+			t.Errorf("interval=%s actual: %+v", interval, err)
+		}
+		if m != nil {
+			m.Close()
+		}
+	}
+}
+
+func TestSyncNotDurable(t *testing.T) {
+	m := New(WithShardSize(2))
+	defer m.Close()
+	m.Set("foo", "bar")
+
+	if err := m.SetSync("hello", "world"); errors.Is(err, ErrNotDurable) != true {
+		t.Errorf("SetSync: %+v", err)
+	}
+	if _, _, err := m.RemoveSync("foo"); errors.Is(err, ErrNotDurable) != true {
+		t.Errorf("RemoveSync: %+v", err)
+	}
+	// nothing is written
+	if _, ok := m.Get("hello"); ok {
+		t.Errorf("not written")
+	}
+	if _, ok := m.Get("foo"); ok != true {
+		t.Errorf("not removed")
+	}
+}
@@ -0,0 +1,105 @@
+package walmap
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSetWithTTL(t *testing.T) {
+	t.Run("expire", func(tt *testing.T) {
+		m := New(WithShardSize(4))
+		m.SetWithTTL("a", "1", 20*time.Millisecond)
+		m.Set("b", "2")
+
+		if v, ok := m.Get("a"); ok != true || v.(string) != "1" {
+			tt.Errorf("a is not expired yet: %v %v", v, ok)
+		}
+		time.Sleep(30 * time.Millisecond)
+
+		if _, ok := m.Get("a"); ok {
+			tt.Errorf("a must be expired")
+		}
+		if m.Len() != 1 {
+			tt.Errorf("expired key is not counted: %d", m.Len())
+		}
+		if keys := m.Keys(); len(keys) != 1 || keys[0] != "b" {
+			tt.Errorf("actual: %v", keys)
+		}
+		if _, ok := m.Remove("a"); ok {
+			tt.Errorf("expired key is missing")
+		}
+	})
+	t.Run("overwrite", func(tt *testing.T) {
+		m := New(WithShardSize(4))
+		m.SetWithTTL("a", "1", 10*time.Millisecond)
+		m.Set("a", "2")
+		time.Sleep(20 * time.Millisecond)
+
+		if v, ok := m.Get("a"); ok != true || v.(string) != "2" {
+			tt.Errorf("Set clears the ttl: %v %v", v, ok)
+		}
+	})
+	t.Run("reap", func(tt *testing.T) {
+		m := New(WithShardSize(4))
+		m.SetWithTTL("a", "1", 10*time.Millisecond)
+		m.SetWithTTL("b", "2", time.Hour)
+		time.Sleep(20 * time.Millisecond)
+
+		prev := m.ReclaimableSpace()
+		n, err := m.ReapExpired()
+		if err != nil {
+			tt.Errorf("no error: %+v", err)
+		}
+		if n != 1 {
+			tt.Errorf("actual: %d", n)
+		}
+		if m.ReclaimableSpace() <= prev {
+			tt.Errorf("reaped record is reclaimable: prev=%d curr=%d", prev, m.ReclaimableSpace())
+		}
+		if err := m.Compact(); err != nil {
+			tt.Errorf("no error: %+v", err)
+		}
+		if v, ok := m.Get("b"); ok != true || v.(string) != "2" {
+			tt.Errorf("actual: %v %v", v, ok)
+		}
+	})
+	t.Run("reaper", func(tt *testing.T) {
+		m := New(WithShardSize(4), WithExpiryReaper(5*time.Millisecond))
+		defer m.Close()
+
+		m.SetWithTTL("a", "1", time.Millisecond)
+		deadline := time.Now().Add(time.Second)
+		for m.ReclaimableSpace() == 0 {
+			if deadline.Before(time.Now()) {
+				tt.Fatalf("reaper did not remove expired key")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+	t.Run("snapshot", func(tt *testing.T) {
+		m := New(WithShardSize(4))
+		m.SetWithTTL("a", "1", 30*time.Millisecond)
+		m.SetWithTTL("b", "2", time.Hour)
+
+		out := bytes.NewBuffer(nil)
+		if err := m.Snapshot(out); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		r, err := Restore(out, WithShardSize(4))
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if _, ok := r.Get("a"); ok != true {
+			tt.Errorf("a is not expired yet")
+		}
+		time.Sleep(40 * time.Millisecond)
+
+		if _, ok := r.Get("a"); ok {
+			tt.Errorf("expiry must survive restore")
+		}
+		if v, ok := r.Get("b"); ok != true || v.(string) != "2" {
+			tt.Errorf("actual: %v %v", v, ok)
+		}
+	})
+}
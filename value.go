@@ -0,0 +1,208 @@
+package walmap
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ValueCodec converts the values of a Map to the bytes stored in its logs.
+type ValueCodec[V any] interface {
+	Encode(w io.Writer, value V) error
+	Decode(data []byte) (V, error)
+}
+
+const (
+	valueCodecItem   uint8 = 0 // WALMap: gob encoded item{Value}
+	valueCodecBytes  uint8 = 1
+	valueCodecString uint8 = 2
+	valueCodecJSON   uint8 = 3
+	valueCodecGob    uint8 = 4
+	valueCodecBinary uint8 = 5
+	valueCodecCustom uint8 = 0xff
+)
+
+// valueCodecIdentifier is implemented by the built-in codecs so that snapshots record which one wrote them.
+type valueCodecIdentifier interface {
+	valueCodecID() uint8
+}
+
+func valueCodecIDOf[V any](codec ValueCodec[V]) uint8 {
+	if c, ok := codec.(valueCodecIdentifier); ok {
+		return c.valueCodecID()
+	}
+	return valueCodecCustom
+}
+
+var (
+	_ ValueCodec[any]    = itemCodec{}
+	_ ValueCodec[[]byte] = bytesCodec{}
+	_ ValueCodec[string] = stringCodec{}
+)
+
+type item struct {
+	Value interface{}
+}
+
+// itemCodec is the codec of WALMap, any value registered to gob can be stored.
+type itemCodec struct{}
+
+func (itemCodec) Encode(w io.Writer, value any) error {
+	if err := gob.NewEncoder(w).Encode(item{value}); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (itemCodec) Decode(data []byte) (any, error) {
+	i := item{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&i); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return i.Value, nil
+}
+
+func (itemCodec) valueCodecID() uint8 {
+	return valueCodecItem
+}
+
+type bytesCodec struct{}
+
+func (bytesCodec) Encode(w io.Writer, value []byte) error {
+	if _, err := w.Write(value); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (bytesCodec) Decode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (bytesCodec) valueCodecID() uint8 {
+	return valueCodecBytes
+}
+
+// BytesCodec stores []byte values as is.
+func BytesCodec() ValueCodec[[]byte] {
+	return bytesCodec{}
+}
+
+type stringCodec struct{}
+
+func (stringCodec) Encode(w io.Writer, value string) error {
+	if _, err := io.WriteString(w, value); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (stringCodec) Decode(data []byte) (string, error) {
+	return string(data), nil
+}
+
+func (stringCodec) valueCodecID() uint8 {
+	return valueCodecString
+}
+
+// StringCodec stores string values as is.
+func StringCodec() ValueCodec[string] {
+	return stringCodec{}
+}
+
+type jsonCodec[V any] struct{}
+
+func (jsonCodec[V]) Encode(w io.Writer, value V) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (jsonCodec[V]) Decode(data []byte) (V, error) {
+	var value V
+	if err := json.Unmarshal(data, &value); err != nil {
+		return value, errors.WithStack(err)
+	}
+	return value, nil
+}
+
+func (jsonCodec[V]) valueCodecID() uint8 {
+	return valueCodecJSON
+}
+
+// JSONCodec stores values with encoding/json.
+func JSONCodec[V any]() ValueCodec[V] {
+	return jsonCodec[V]{}
+}
+
+type gobCodec[V any] struct{}
+
+func (gobCodec[V]) Encode(w io.Writer, value V) error {
+	if err := gob.NewEncoder(w).Encode(value); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (gobCodec[V]) Decode(data []byte) (V, error) {
+	var value V
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&value); err != nil {
+		return value, errors.WithStack(err)
+	}
+	return value, nil
+}
+
+func (gobCodec[V]) valueCodecID() uint8 {
+	return valueCodecGob
+}
+
+// GobCodec stores values with encoding/gob, unlike WALMap concrete types need no gob.Register.
+func GobCodec[V any]() ValueCodec[V] {
+	return gobCodec[V]{}
+}
+
+// BinaryValue is a pointer to V that implements encoding.BinaryMarshaler and encoding.BinaryUnmarshaler.
+type BinaryValue[V any] interface {
+	*V
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+type binaryCodec[V any, P BinaryValue[V]] struct{}
+
+func (binaryCodec[V, P]) Encode(w io.Writer, value V) error {
+	data, err := P(&value).MarshalBinary()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (binaryCodec[V, P]) Decode(data []byte) (V, error) {
+	var value V
+	if err := P(&value).UnmarshalBinary(data); err != nil {
+		return value, errors.WithStack(err)
+	}
+	return value, nil
+}
+
+func (binaryCodec[V, P]) valueCodecID() uint8 {
+	return valueCodecBinary
+}
+
+// BinaryCodec stores values with their MarshalBinary / UnmarshalBinary methods.
+func BinaryCodec[V any, P BinaryValue[V]]() ValueCodec[V] {
+	return binaryCodec[V, P]{}
+}
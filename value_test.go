@@ -0,0 +1,90 @@
+package walmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+type testJSONValue struct {
+	Name string `json:"name"`
+	Age  int    `json:"age"`
+}
+
+type testBinaryValue struct {
+	A uint32
+	B uint32
+}
+
+func (v *testBinaryValue) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data[0:], v.A)
+	binary.BigEndian.PutUint32(data[4:], v.B)
+	return data, nil
+}
+
+func (v *testBinaryValue) UnmarshalBinary(data []byte) error {
+	if len(data) != 8 {
+		return errors.New("invalid size")
+	}
+	v.A = binary.BigEndian.Uint32(data[0:])
+	v.B = binary.BigEndian.Uint32(data[4:])
+	return nil
+}
+
+func testValueCodecRoundtrip[V any](t *testing.T, valueCodec ValueCodec[V], value V, equal func(a, b V) bool) {
+	out := bytes.NewBuffer(nil)
+	if err := valueCodec.Encode(out, value); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	decoded, err := valueCodec.Decode(out.Bytes())
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	if equal(value, decoded) != true {
+		t.Errorf("expect: %v actual: %v", value, decoded)
+	}
+}
+
+func TestValueCodec(t *testing.T) {
+	t.Run("bytes", func(tt *testing.T) {
+		testValueCodecRoundtrip(tt, BytesCodec(), []byte("hello"), bytes.Equal)
+	})
+	t.Run("string", func(tt *testing.T) {
+		testValueCodecRoundtrip(tt, StringCodec(), "hello", func(a, b string) bool { return a == b })
+	})
+	t.Run("json", func(tt *testing.T) {
+		testValueCodecRoundtrip(tt, JSONCodec[testJSONValue](), testJSONValue{"foo", 12}, func(a, b testJSONValue) bool { return a == b })
+	})
+	t.Run("gob", func(tt *testing.T) {
+		testValueCodecRoundtrip(tt, GobCodec[testJSONValue](), testJSONValue{"bar", 34}, func(a, b testJSONValue) bool { return a == b })
+	})
+	t.Run("binary", func(tt *testing.T) {
+		testValueCodecRoundtrip(tt, BinaryCodec[testBinaryValue](), testBinaryValue{1, 2}, func(a, b testBinaryValue) bool { return a == b })
+	})
+	t.Run("item", func(tt *testing.T) {
+		testValueCodecRoundtrip[any](tt, itemCodec{}, testStruct{123}, func(a, b any) bool { return a == b })
+	})
+}
+
+func TestValueCodecID(t *testing.T) {
+	ids := []uint8{
+		valueCodecIDOf[any](itemCodec{}),
+		valueCodecIDOf(BytesCodec()),
+		valueCodecIDOf(StringCodec()),
+		valueCodecIDOf(JSONCodec[testJSONValue]()),
+		valueCodecIDOf(GobCodec[testJSONValue]()),
+		valueCodecIDOf(BinaryCodec[testBinaryValue]()),
+	}
+	uniq := make(map[uint8]struct{}, len(ids))
+	for _, id := range ids {
+		if id == valueCodecCustom {
+			t.Errorf("built-in codec: %d", id)
+		}
+		uniq[id] = struct{}{}
+	}
+	if len(uniq) != len(ids) {
+		t.Errorf("duplicate id: %v", ids)
+	}
+}
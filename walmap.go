@@ -2,38 +2,75 @@ package walmap
 
 import (
 	"io"
+	"log/slog"
+	"os"
+	"time"
 
 	"github.com/octu0/cmap"
 	"github.com/pkg/errors"
 )
 
 const (
-	defaultShardSize     int = 1024
-	defaultCacheCapacity int = 64
-	defaultLogSize       int = 32 * 1024
-	defaultIndexSize     int = 1024
+	defaultShardSize int = 1024
+	defaultLogSize   int = 32 * 1024
+	defaultIndexSize int = 1024
 )
 
 type walmapOptFunc func(*walmapOpt)
 
 type walmapOpt struct {
-	shardSize        int
-	cacheCapacity    int
-	initialLogSize   int
-	initialIndexSize int
-	hashFunc         cmap.CMapHashFunc
-	bufferPool       BufferPool
+	shardSize          int
+	shardSizeSet       bool
+	initialLogSize     int
+	initialIndexSize   int
+	hashFunc           cmap.CMapHashFunc
+	bufferPool         BufferPool
+	syncPolicy         SyncPolicy
+	recoveryFunc       RecoveryFunc
+	rebalance          bool
+	valueCodecID       uint8
+	errorHandler       ErrorHandler
+	reapInterval       time.Duration
+	compactPolicy      CompactPolicy
+	consistent         bool
+	concurrency        int
+	compression        Compression
+	subscriptionBuffer int
+	heartbeatInterval  time.Duration
+	orderedIndex       bool
 }
 
+// ErrorHandler receives the errors of the methods that have no error return value (Set, Get, Remove...).
+// op is the name of the method and key is empty for errors that are not tied to a key.
+type ErrorHandler func(op string, key string, err error)
+
+var (
+	defaultErrorHandler = loggerErrorHandler(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+)
+
+func loggerErrorHandler(logger *slog.Logger) ErrorHandler {
+	return func(op string, key string, err error) {
+		logger.Error("walmap: "+op+" failed", slog.String("op", op), slog.String("key", key), slog.Any("error", err))
+	}
+}
+
+// RecoveryFunc receives the torn tail dropped from a shard's log.
+type RecoveryFunc func(shard int, recovery Recovery)
+
+// WithShardSize sets the number of shards, at least 1.
+// Restore redistributes the records when it differs from the shard size of the snapshot.
+// Open and Restore fail with ErrInvalidShardSize below 1, New reports it to the ErrorHandler and uses the default.
 func WithShardSize(size int) walmapOptFunc {
 	return func(opt *walmapOpt) {
 		opt.shardSize = size
+		opt.shardSizeSet = true
 	}
 }
 
+// WithCacheCapacity sets the initial capacity of each shard's index like cmap.WithCacheCapacity, same as WithInitialIndexSize.
 func WithCacheCapacity(size int) walmapOptFunc {
 	return func(opt *walmapOpt) {
-		opt.cacheCapacity = size
+		opt.initialIndexSize = size
 	}
 }
 
@@ -61,152 +98,161 @@ func WithBufferPool(pool BufferPool) walmapOptFunc {
 	}
 }
 
-func newDefaultOption() *walmapOpt {
-	return &walmapOpt{
-		shardSize:        defaultShardSize,
-		cacheCapacity:    defaultCacheCapacity,
-		initialLogSize:   defaultLogSize,
-		initialIndexSize: defaultIndexSize,
-		hashFunc:         cmap.NewXXHashFunc(),
-		bufferPool:       newDefaultBufferPool(),
+// WithSyncPolicy sets the durability policy of the segment files, it only applies to maps opened by Open.
+func WithSyncPolicy(policy SyncPolicy) walmapOptFunc {
+	return func(opt *walmapOpt) {
+		opt.syncPolicy = policy
 	}
 }
 
-type WALMap struct {
-	s *shards
+// WithRecovery makes Open and Restore drop a torn or corrupt tail of each shard's log (e.g. after a crash mid-write)
+// instead of failing, fn is called for every shard that had a tail dropped.
+func WithRecovery(fn RecoveryFunc) walmapOptFunc {
+	return func(opt *walmapOpt) {
+		opt.recoveryFunc = fn
+	}
 }
 
-func (c *WALMap) Set(key string, value interface{}) {
-	m := c.s.GetShard(key)
-	m.Lock()
-	defer m.Unlock()
-
-	m.Set(key, value)
+// WithRebalance makes Restore move records to the shards of the current hash function
+// when the snapshot was taken with a different one, instead of failing with ErrHashFuncMismatch.
+func WithRebalance() walmapOptFunc {
+	return func(opt *walmapOpt) {
+		opt.rebalance = true
+	}
 }
 
-func (c *WALMap) Get(key string) (interface{}, bool) {
-	m := c.s.GetShard(key)
-	m.RLock()
-	defer m.RUnlock()
-
-	return m.Get(key)
+// WithErrorHandler sets the handler of errors from methods without error return value, errors are logged to os.Stderr by default.
+func WithErrorHandler(handler ErrorHandler) walmapOptFunc {
+	return func(opt *walmapOpt) {
+		opt.errorHandler = handler
+	}
 }
 
-func (c *WALMap) Remove(key string) (interface{}, bool) {
-	m := c.s.GetShard(key)
-	m.Lock()
-	defer m.Unlock()
-
-	return m.Remove(key)
+// WithLogger logs errors from methods without error return value to logger.
+func WithLogger(logger *slog.Logger) walmapOptFunc {
+	return func(opt *walmapOpt) {
+		opt.errorHandler = loggerErrorHandler(logger)
+	}
 }
 
-func (c *WALMap) Len() int {
-	count := 0
-	for _, m := range c.s.Shards() {
-		m.RLock()
-		count += m.Len()
-		m.RUnlock()
+// WithExpiryReaper removes the keys expired by SetWithTTL every interval in the background, until Close.
+func WithExpiryReaper(interval time.Duration) walmapOptFunc {
+	return func(opt *walmapOpt) {
+		opt.reapInterval = interval
 	}
-	return count
 }
 
-func (c *WALMap) Keys() []string {
-	shards := c.s.Shards()
-	keys := make([]string, 0, len(shards))
-	for _, m := range shards {
-		m.RLock()
-		keys = append(keys, m.Keys()...)
-		m.RUnlock()
+// WithAutoCompact compacts the shards that pass the threshold of policy in the background, until Close.
+func WithAutoCompact(policy CompactPolicy) walmapOptFunc {
+	return func(opt *walmapOpt) {
+		opt.compactPolicy = policy
 	}
-	return keys
 }
 
-func (c *WALMap) Upsert(key string, fn cmap.UpsertFunc) (newValue interface{}) {
-	m := c.s.GetShard(key)
-	m.Lock()
-	defer m.Unlock()
-
-	oldValue, ok := m.Get(key)
-	newValue = fn(ok, oldValue)
-	m.Set(key, newValue)
-	return
+// WithConsistentSnapshot makes Snapshot capture all shards at the same instant (see Map.SnapshotConsistent).
+func WithConsistentSnapshot() walmapOptFunc {
+	return func(opt *walmapOpt) {
+		opt.consistent = true
+	}
 }
 
-func (c *WALMap) SetIfAbsent(key string, value interface{}) (updated bool) {
-	m := c.s.GetShard(key)
-	m.Lock()
-	defer m.Unlock()
-
-	if _, ok := m.Get(key); ok != true {
-		m.Set(key, value)
-		return true
+// WithConcurrency sets the number of shards Restore rebuilds in parallel, 1 by default.
+// Snapshot compresses that many shards in parallel with WithSnapshotCompression, otherwise it streams the shard logs as is.
+func WithConcurrency(n int) walmapOptFunc {
+	return func(opt *walmapOpt) {
+		opt.concurrency = n
 	}
-	return false
 }
 
-func (c *WALMap) RemoveIf(key string, fn cmap.RemoveIfFunc) (removed bool) {
-	m := c.s.GetShard(key)
-	m.Lock()
-	defer m.Unlock()
+// WithSnapshotCompression makes Snapshot compress each shard block with compression.
+// Restore decompresses the built-in ones on its own, a custom compression must be given to Restore as well.
+func WithSnapshotCompression(compression Compression) walmapOptFunc {
+	return func(opt *walmapOpt) {
+		opt.compression = compression
+	}
+}
 
-	v, ok := m.Get(key)
-	remove := fn(ok, v)
-	if remove && ok {
-		m.Remove(key)
-		return true
+// WithSubscriptionBuffer sets the number of events a subscriber can fall behind before it is ended with ErrLagged.
+// size must be at least 1, Subscribe returns a subscription ended with ErrInvalidSubscriptionBuffer otherwise.
+func WithSubscriptionBuffer(size int) walmapOptFunc {
+	return func(opt *walmapOpt) {
+		opt.subscriptionBuffer = size
 	}
-	return false
 }
 
-func (c *WALMap) Snapshot(w io.Writer) error {
-	if err := c.s.Snapshot(w); err != nil {
-		return errors.WithStack(err)
+// WithHeartbeatInterval sets how often Replicate tells an idle follower that it is up to date, every second by default.
+// interval must be positive, Replicate fails with ErrInvalidHeartbeatInterval otherwise.
+func WithHeartbeatInterval(interval time.Duration) walmapOptFunc {
+	return func(opt *walmapOpt) {
+		opt.heartbeatInterval = interval
 	}
-	return nil
 }
 
-func (c *WALMap) ReclaimableSpace() uint64 {
-	sum := uint64(0)
-	for _, m := range c.s.Shards() {
-		sum += m.ReclaimableSpace()
+// WithOrderedIndex keeps the keys of each shard in order, so ScanPrefix and Range walk only the matching keys.
+// without it they sort the matching keys of each shard on every call.
+func WithOrderedIndex() walmapOptFunc {
+	return func(opt *walmapOpt) {
+		opt.orderedIndex = true
 	}
-	return sum
 }
 
-func (c *WALMap) Size() uint64 {
-	sum := uint64(0)
-	for _, m := range c.s.Shards() {
-		sum += m.Size()
+func newOption(valueCodecID uint8, funcs ...walmapOptFunc) *walmapOpt {
+	opt := newDefaultOption()
+	opt.valueCodecID = valueCodecID
+	for _, fn := range funcs {
+		fn(opt)
 	}
-	return sum
+	return opt
 }
 
-func (c *WALMap) Compact() error {
-	for _, m := range c.s.Shards() {
-		if err := m.Compact(); err != nil {
-			return errors.WithStack(err)
-		}
+func newDefaultOption() *walmapOpt {
+	return &walmapOpt{
+		shardSize:          defaultShardSize,
+		initialLogSize:     defaultLogSize,
+		initialIndexSize:   defaultIndexSize,
+		hashFunc:           cmap.NewXXHashFunc(),
+		bufferPool:         newDefaultBufferPool(),
+		syncPolicy:         SyncNone,
+		errorHandler:       defaultErrorHandler,
+		concurrency:        1,
+		subscriptionBuffer: defaultSubscriptionBuffer,
+		heartbeatInterval:  defaultHeartbeatInterval,
 	}
-	return nil
+}
+
+// WALMap is a Map of any value registered to gob, compatible with cmap.Cache.
+type WALMap struct {
+	*Map[any]
+}
+
+func (c *WALMap) Upsert(key string, fn cmap.UpsertFunc) (newValue interface{}) {
+	return c.Map.Upsert(key, fn)
+}
+
+func (c *WALMap) RemoveIf(key string, fn cmap.RemoveIfFunc) (removed bool) {
+	return c.Map.RemoveIf(key, fn)
 }
 
 func Restore(r io.Reader, funcs ...walmapOptFunc) (*WALMap, error) {
-	opt := newDefaultOption()
-	for _, fn := range funcs {
-		fn(opt)
+	m, err := RestoreMap[any](r, itemCodec{}, funcs...)
+	if err != nil {
+		return nil, errors.WithStack(err)
 	}
-	s, err := restoreShards(r, opt)
+	return &WALMap{m}, nil
+}
+
+// Open returns a durable map whose shards append to segment files in dir.
+// existing segments are replayed to rebuild the map, so the shard size must match the one used to create dir.
+// a different WithShardSize fails with ErrShardSizeMismatch and Reshard is not supported on the returned map:
+// to change the shard size, Restore a snapshot with the new size and apply it to a new dir (see README).
+func Open(dir string, funcs ...walmapOptFunc) (*WALMap, error) {
+	m, err := OpenMap[any](dir, itemCodec{}, funcs...)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	return &WALMap{s}, nil
+	return &WALMap{m}, nil
 }
 
 func New(funcs ...walmapOptFunc) *WALMap {
-	opt := newDefaultOption()
-	for _, fn := range funcs {
-		fn(opt)
-	}
-	s := newShards(opt)
-	return &WALMap{s}
+	return &WALMap{NewMap[any](itemCodec{}, funcs...)}
 }
@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"encoding/gob"
 	"errors"
+	"fmt"
 	"io"
 	"math/rand"
+	"os"
+	"runtime"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -179,6 +183,25 @@ func BenchmarkSnapshot(b *testing.B) {
 			}
 		}
 	})
+	b.Run("walmap/restore/500_000/concurrency", func(tb *testing.B) {
+		old := New()
+		prepare(old, 500_000)
+		buf := bytes.NewBuffer(nil)
+		if err := old.Snapshot(buf); err != nil {
+			tb.Fatalf("no error: %+v", err)
+		}
+		tb.ResetTimer()
+		for i := 0; i < tb.N; i += 1 {
+			r := bytes.NewReader(buf.Bytes())
+			w, err := Restore(r, WithConcurrency(runtime.NumCPU()))
+			if err != nil {
+				tb.Fatalf("no error: %+v", err)
+			}
+			if w.Len() != 500_000 {
+				tb.Errorf("restore failed: %d", w.Len())
+			}
+		}
+	})
 }
 
 func TestSetGet(t *testing.T) {
@@ -202,3 +225,352 @@ func TestSetGet(t *testing.T) {
 		}
 	}
 }
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+
+	m1, err := Open(dir, WithShardSize(8))
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	m1.Set("foo", "bar")
+	m1.Set("hello", "world")
+	m1.Set("hello", "world2")
+	m1.Set("removed", "value")
+	m1.Remove("removed")
+	if err := m1.Close(); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+
+	m2, err := Open(dir, WithShardSize(8))
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	defer m2.Close()
+
+	if m2.Len() != 2 {
+		t.Errorf("actual: %d", m2.Len())
+	}
+	if _, ok := m2.Get("removed"); ok {
+		t.Errorf("removed key reopened")
+	}
+	if v, ok := m2.Get("foo"); ok != true {
+		t.Errorf("exists")
+	} else {
+		if v.(string) != "bar" {
+			t.Errorf("actual: %v", v)
+		}
+	}
+	if v, ok := m2.Get("hello"); ok != true {
+		t.Errorf("exists")
+	} else {
+		if v.(string) != "world2" {
+			t.Errorf("actual: %v", v)
+		}
+	}
+
+	m2.Set("test", "value")
+	if v, ok := m2.Get("test"); ok != true {
+		t.Errorf("exists")
+	} else {
+		if v.(string) != "value" {
+			t.Errorf("actual: %v", v)
+		}
+	}
+
+	if _, err := Open(dir, WithShardSize(16)); errors.Is(err, ErrShardSizeMismatch) != true {
+		t.Errorf("shard size mismatch: %+v", err)
+	}
+}
+
+func TestRemoveSnapshotRestore(t *testing.T) {
+	m1 := New()
+	m1.Set("foo", "bar")
+	m1.Set("hello", "world")
+	m1.Remove("hello")
+
+	out := bytes.NewBuffer(nil)
+	if err := m1.Snapshot(out); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	m2, err := Restore(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	if m2.Len() != 1 {
+		t.Errorf("actual: %d", m2.Len())
+	}
+	if _, ok := m2.Get("hello"); ok {
+		t.Errorf("removed key restored")
+	}
+	if v, ok := m2.Get("foo"); ok != true {
+		t.Errorf("exists")
+	} else {
+		if v.(string) != "bar" {
+			t.Errorf("actual: %v", v)
+		}
+	}
+}
+
+func TestOpenRecovery(t *testing.T) {
+	dir := t.TempDir()
+
+	m1, err := Open(dir, WithShardSize(1))
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	m1.Set("foo", "bar")
+	m1.Set("hello", "world")
+	if err := m1.Close(); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+
+	path := segmentPath(dir, 0)
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	// crash in the middle of writing "hello"
+	if err := os.Truncate(path, stat.Size()-2); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+
+	if _, err := Open(dir, WithShardSize(1)); err == nil {
+		t.Errorf("torn tail must be error")
+	}
+
+	recovered := make(map[int]Recovery)
+	m2, err := Open(dir, WithShardSize(1), WithRecovery(func(shard int, recovery Recovery) {
+		recovered[shard] = recovery
+	}))
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	defer m2.Close()
+
+	if r, ok := recovered[0]; ok != true {
+		t.Errorf("recovered shard 0")
+	} else {
+		if r.DroppedRecords != 1 {
+			t.Errorf("actual: %d", r.DroppedRecords)
+		}
+	}
+	if m2.Len() != 1 {
+		t.Errorf("actual: %d", m2.Len())
+	}
+	if v, ok := m2.Get("foo"); ok != true {
+		t.Errorf("exists")
+	} else if v.(string) != "bar" {
+		t.Errorf("actual: %v", v)
+	}
+}
+
+func TestRestoreConcurrency(t *testing.T) {
+	m := New(WithShardSize(16))
+	for i := 0; i < 1000; i += 1 {
+		m.Set("key"+strconv.Itoa(i), i)
+	}
+	out := bytes.NewBuffer(nil)
+	if err := m.Snapshot(out); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+
+	t.Run("restore", func(tt *testing.T) {
+		r, err := Restore(bytes.NewReader(out.Bytes()), WithShardSize(16), WithConcurrency(4))
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if r.Len() != 1000 {
+			tt.Errorf("actual: %d", r.Len())
+		}
+		for i := 0; i < 1000; i += 1 {
+			if v, ok := r.Get("key" + strconv.Itoa(i)); ok != true || v.(int) != i {
+				tt.Errorf("key%d actual: %v %v", i, v, ok)
+			}
+		}
+	})
+	t.Run("recovery", func(tt *testing.T) {
+		// corrupt the last record of the last shard
+		data := bytes.Clone(out.Bytes())
+		data[len(data)-1] ^= 0xff
+
+		shards := []int{}
+		r, err := Restore(bytes.NewReader(data), WithShardSize(16), WithConcurrency(4), WithRecovery(func(shard int, recovery Recovery) {
+			shards = append(shards, shard)
+		}))
+		if err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if len(shards) != 1 || shards[0] != 15 {
+			tt.Errorf("actual: %v", shards)
+		}
+		if r.Len() != 999 {
+			tt.Errorf("actual: %d", r.Len())
+		}
+	})
+	t.Run("corrupt", func(tt *testing.T) {
+		data := bytes.Clone(out.Bytes())
+		data[len(data)-1] ^= 0xff
+
+		if _, err := Restore(bytes.NewReader(data), WithShardSize(16), WithConcurrency(4)); err == nil {
+			tt.Errorf("corrupt shard must fail")
+		}
+	})
+}
+
+func TestReshard(t *testing.T) {
+	m := New(WithShardSize(4))
+	for i := 0; i < 1000; i += 1 {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	wg := new(sync.WaitGroup)
+	for g := 0; g < 4; g += 1 {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i += 1 {
+				key := fmt.Sprintf("g%d-%d", g, i)
+				m.Set(key, i)
+				if v, ok := m.Get(key); ok != true || v.(int) != i {
+					t.Errorf("%s actual: %v", key, v)
+				}
+			}
+		}(g)
+	}
+	for _, size := range []int{16, 64, 8} {
+		if err := m.Reshard(size); err != nil {
+			t.Errorf("no error: %+v", err)
+		}
+	}
+	wg.Wait()
+
+	if n := len(m.s.Load().Shards()); n != 8 {
+		t.Errorf("shard size actual: %d", n)
+	}
+	if m.Len() != 1000+(4*500) {
+		t.Errorf("actual: %d", m.Len())
+	}
+	for i := 0; i < 1000; i += 1 {
+		v, ok := m.Get(strconv.Itoa(i))
+		if ok != true {
+			t.Errorf("exists key: %d", i)
+			continue
+		}
+		if v.(int) != i {
+			t.Errorf("actual: %v", v)
+		}
+	}
+
+	durable, err := Open(t.TempDir(), WithShardSize(4))
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	defer durable.Close()
+	if err := durable.Reshard(8); errors.Is(err, ErrReshardDurable) != true {
+		t.Errorf("durable: %+v", err)
+	}
+}
+
+func TestInvalidShardSize(t *testing.T) {
+	t.Run("Reshard", func(tt *testing.T) {
+		m := New(WithShardSize(4))
+		defer m.Close()
+		m.Set("foo", "bar")
+
+		for _, size := range []int{0, -1} {
+			if err := m.Reshard(size); errors.Is(err, ErrInvalidShardSize) != true {
+				tt.Errorf("size=%d actual: %+v", size, err)
+			}
+		}
+		if v, ok := m.Get("foo"); ok != true || v.(string) != "bar" {
+			tt.Errorf("actual: %v %v", v, ok)
+		}
+	})
+	t.Run("Open", func(tt *testing.T) {
+		if _, err := Open(tt.TempDir(), WithShardSize(0)); errors.Is(err, ErrInvalidShardSize) != true {
+			tt.Errorf("actual: %+v", err)
+		}
+	})
+	t.Run("Restore", func(tt *testing.T) {
+		m := New(WithShardSize(4))
+		defer m.Close()
+		out := bytes.NewBuffer(nil)
+		if err := m.Snapshot(out); err != nil {
+			tt.Fatalf("no error: %+v", err)
+		}
+		if _, err := Restore(out, WithShardSize(0)); errors.Is(err, ErrInvalidShardSize) != true {
+			tt.Errorf("actual: %+v", err)
+		}
+	})
+	t.Run("New", func(tt *testing.T) {
+		var reported error
+		m := New(WithShardSize(0), WithErrorHandler(func(op, key string, err error) {
+			reported = err
+		}))
+		defer m.Close()
+
+		if errors.Is(reported, ErrInvalidShardSize) != true {
+			tt.Errorf("actual: %+v", reported)
+		}
+		m.Set("foo", "bar")
+		if v, ok := m.Get("foo"); ok != true || v.(string) != "bar" {
+			tt.Errorf("actual: %v %v", v, ok)
+		}
+	})
+}
+
+func TestReshardDurableCopy(t *testing.T) {
+	m, err := Open(t.TempDir(), WithShardSize(4))
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	defer m.Close()
+	for i := 0; i < 100; i += 1 {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	// the procedure of README: restore with the new size and apply it to a new dir
+	snapshot := bytes.NewBuffer(nil)
+	if err := m.Snapshot(snapshot); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	resized, err := Restore(snapshot, WithShardSize(16))
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	defer resized.Close()
+	base := bytes.NewBuffer(nil)
+	if _, err := resized.SnapshotSince(base, SnapshotToken{}); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+
+	dir := t.TempDir()
+	m2, err := Open(dir, WithShardSize(16))
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	if err := m2.ApplyDelta(base); err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	if err := m2.Close(); err != nil {
+		t.Errorf("no error: %+v", err)
+	}
+
+	m3, err := Open(dir, WithShardSize(16))
+	if err != nil {
+		t.Fatalf("no error: %+v", err)
+	}
+	defer m3.Close()
+	if m3.Len() != 100 {
+		t.Errorf("actual: %d", m3.Len())
+	}
+	for i := 0; i < 100; i += 1 {
+		if v, ok := m3.Get(strconv.Itoa(i)); ok != true || v.(int) != i {
+			t.Errorf("%d actual: %v %v", i, v, ok)
+		}
+	}
+	if _, err := Open(dir, WithShardSize(4)); errors.Is(err, ErrShardSizeMismatch) != true {
+		t.Errorf("shard size mismatch: %+v", err)
+	}
+}